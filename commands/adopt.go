@@ -0,0 +1,348 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/profiles/latest/resources/mgmt/resources"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// Adopt creates a command to rebuild the local state for a cluster from its resource group in Azure.
+// This is used to manage a cluster which was created on another machine, or whose local state was lost.
+func Adopt(ctx context.Context, stateDir string, cfg *UserConfig) *cobra.Command {
+	var (
+		name           string
+		identityFile   string
+		subscriptionID string
+		cloud          string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "adopt <resource group>",
+		Short: "Rebuild the local state for a cluster from its resource group in Azure",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var err error
+			subscriptionID, err = resolveSubscription(subscriptionID, cfg)
+			if err != nil {
+				return err
+			}
+			cloudName, customEnv, err := resolveCloud(cloud, cfg)
+			if err != nil {
+				return err
+			}
+			if identityFile != "" {
+				identityFile, err = filepath.Abs(identityFile)
+				if err != nil {
+					return errors.Wrap(err, "error resolving path to ssh identity file")
+				}
+			}
+			s := state{SubscriptionID: subscriptionID, Cloud: cloudName, CloudEnvironment: customEnv, SSHIdentityFile: identityFile}
+			return runAdopt(ctx, args[0], name, stateDir, s, cmd.OutOrStderr())
+		},
+	}
+
+	flags := cmd.Flags()
+	flags.StringVar(&name, "name", "", "Name to use for the cluster, defaults to the name it was created with")
+	flags.StringVarP(&identityFile, "identity-file", "i", "", "Private SSH key for the cluster, used to fetch the kubeconfig from a leader node")
+	flags.StringVarP(&subscriptionID, "subscription", "s", "", "Subscription the resource group is in")
+	flags.StringVar(&cloud, "cloud", "", "Azure cloud the resource group is in, defaults to the cloud selected in the azure CLI")
+	return cmd
+}
+
+// runAdopt adopts the cluster in the resource group.
+// The subscription, cloud and ssh identity file to use are passed in through base.
+func runAdopt(ctx context.Context, group, name, stateDir string, base state, errW io.Writer) (retErr error) {
+	subscriptionID := base.SubscriptionID
+	backend := newBackend()
+	gClient, err := backend.groups(base)
+	if err != nil {
+		return err
+	}
+	g, err := gClient.Get(ctx, group)
+	if err != nil {
+		if isAzureNotFound(err) {
+			return errors.Errorf("resource group %q not found in subscription %q", group, subscriptionID)
+		}
+		return errors.Wrapf(err, "error getting resource group %q", group)
+	}
+
+	if name == "" {
+		name = group
+		if v := g.Tags[tagCluster]; v != nil && *v != "" {
+			name = *v
+		}
+	}
+
+	dir := filepath.Join(stateDir, name)
+	if _, err := os.Stat(dir); err == nil {
+		return errors.Errorf("cluster with name %q already exists", name)
+	}
+
+	dClient, err := backend.deployments(base)
+	if err != nil {
+		return err
+	}
+	deployment, err := findClusterDeployment(ctx, dClient, group)
+	if err != nil {
+		return err
+	}
+
+	s, model := stateFromDeployment(g, deployment)
+	s.SubscriptionID = subscriptionID
+	s.Cloud = base.Cloud
+	s.CloudEnvironment = base.CloudEnvironment
+	s.SSHIdentityFile = base.SSHIdentityFile
+	setModelCloud(model, s.Location, s.CloudEnvironment)
+
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return errors.Wrap(err, "error creating state dir")
+	}
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return errors.Wrapf(err, "error creating state dir %s", dir)
+	}
+	defer func() {
+		if retErr != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	if err := writeState(dir, s); err != nil {
+		return err
+	}
+	if _, err := writeAPIModel(dir, model); err != nil {
+		return err
+	}
+
+	if s.Status == stateCreating {
+		io.WriteString(errW, "The deployment is still running, use `testrig wait "+name+"` to wait for it\n")
+		return nil
+	}
+	if s.Status != stateReady {
+		return nil
+	}
+
+	// The rest of the state is still useful without the kubeconfig, so failing to fetch it does not fail the whole thing.
+	// The reason is recorded so commands which need the kubeconfig can say why it is missing.
+	var data []byte
+	if s.SSHIdentityFile == "" {
+		err = errors.New("no ssh identity file provided")
+	} else {
+		data, err = fetchKubeConfig(ctx, s.SSHIdentityFile, model.Properties.LinuxProfile.AdminUsername, makeFQDN(s))
+	}
+	if err != nil {
+		s.FailureMessage = "kubeconfig was not fetched when the cluster was adopted: " + err.Error()
+		io.WriteString(errW, s.FailureMessage+"\n")
+		return writeState(dir, s)
+	}
+	kubeConfigDir := filepath.Join(dir, "_output", "kubeconfig")
+	if err := os.MkdirAll(kubeConfigDir, 0700); err != nil {
+		return errors.Wrap(err, "error creating kubeconfig dir")
+	}
+	return errors.Wrap(ioutil.WriteFile(filepath.Join(kubeConfigDir, "kubeconfig."+s.Location+".json"), data, 0600), "error writing kubeconfig")
+}
+
+// findClusterDeployment gets the acs-engine deployment in the resource group.
+// testrig names the deployment after the resource group, otherwise the most recent deployment is used.
+func findClusterDeployment(ctx context.Context, client deploymentsClient, group string) (resources.DeploymentExtended, error) {
+	deployments, err := client.List(ctx, group)
+	if err != nil {
+		return resources.DeploymentExtended{}, errors.Wrapf(err, "error listing deployments in resource group %q", group)
+	}
+
+	var (
+		found  *resources.DeploymentExtended
+		latest time.Time
+	)
+	for i := range deployments {
+		d := &deployments[i]
+		if d.Name != nil && strings.EqualFold(*d.Name, group) {
+			found = d
+			break
+		}
+		if d.Properties != nil && d.Properties.Timestamp != nil && d.Properties.Timestamp.After(latest) {
+			latest = d.Properties.Timestamp.Time
+			found = d
+		}
+	}
+	if found == nil || found.Name == nil {
+		return resources.DeploymentExtended{}, errors.Errorf("no deployments found in resource group %q", group)
+	}
+
+	deployment, err := client.Get(ctx, group, *found.Name)
+	return deployment, errors.Wrapf(err, "error getting deployment %q", *found.Name)
+}
+
+// stateFromDeployment reconstructs the cluster state and a best-effort API model from the resource group and the
+// parameters of the acs-engine deployment.
+func stateFromDeployment(g resources.Group, d resources.DeploymentExtended) (state, *apiModel) {
+	s := state{
+		ResourceGroup: *g.Name,
+		Status:        stateFailure,
+	}
+	if g.Location != nil {
+		s.Location = *g.Location
+	}
+	if d.Name != nil {
+		s.DeploymentName = *d.Name
+	}
+
+	tag := func(k string) string {
+		if v := g.Tags[k]; v != nil {
+			return *v
+		}
+		return ""
+	}
+	s.CreatedBy = tag(tagCreatedBy)
+	if t, err := time.Parse(time.RFC3339, tag(tagCreatedAt)); err == nil {
+		s.CreatedAt = t
+	}
+	if t, err := time.Parse(time.RFC3339, tag(tagExpiresAt)); err == nil {
+		s.ExpiresAt = &t
+	}
+	for k, v := range g.Tags {
+		if !strings.HasPrefix(k, "testrig-") && v != nil {
+			if s.Tags == nil {
+				s.Tags = make(map[string]string)
+			}
+			s.Tags[k] = *v
+		}
+	}
+
+	params := make(map[string]interface{})
+	if d.Properties != nil {
+		if d.Properties.ProvisioningState != nil {
+			switch *d.Properties.ProvisioningState {
+			case "Succeeded":
+				s.Status = stateReady
+			case "Accepted", "Running":
+				// Still deploying, `wait` picks it up from here.
+				s.Status = stateCreating
+			default:
+				s.FailureMessage = "deployment " + strings.ToLower(*d.Properties.ProvisioningState)
+			}
+		}
+		if s.CreatedAt.IsZero() && d.Properties.Timestamp != nil {
+			s.CreatedAt = d.Properties.Timestamp.Time
+		}
+		if p, ok := d.Properties.Parameters.(map[string]interface{}); ok {
+			params = p
+		}
+	}
+
+	param := func(k string) string {
+		p, ok := params[k].(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		switch v := p["value"].(type) {
+		case string:
+			return v
+		case float64:
+			return strconv.Itoa(int(v))
+		}
+		return ""
+	}
+
+	m := &apiModel{
+		APIVersion: "vlabs",
+		Properties: &properties{
+			OrchestratorProfile: &orchestratorProfile{
+				OrchestratorType: "Kubernetes",
+				KubernetesConfig: &kubernetesConfig{
+					NetworkPlugin: param("networkPlugin"),
+					NetworkPolicy: param("networkPolicy"),
+				},
+			},
+			MasterProfile: &masterProfile{
+				VMSize:    param("masterVMSize"),
+				DNSPrefix: param("masterEndpointDNSNamePrefix"),
+			},
+			LinuxProfile: &linuxProfile{
+				AdminUsername: param("linuxAdminUsername"),
+			},
+		},
+	}
+	if spec := param("kubernetesHyperkubeSpec"); strings.Contains(spec, ":v") {
+		m.Properties.OrchestratorProfile.OrchestratorRelease = kubernetesRelease(spec[strings.LastIndex(spec, ":v")+2:])
+	}
+	if count, err := strconv.Atoi(param("masterCount")); err == nil {
+		m.Properties.MasterProfile.Count = count
+	}
+	if m.Properties.LinuxProfile.AdminUsername == "" {
+		m.Properties.LinuxProfile.AdminUsername = "azureuser"
+	}
+	if user := param("windowsAdminUsername"); user != "" {
+		m.Properties.WindowsProfile = &windowsProfile{AdminUsername: user}
+	}
+	if key := param("sshRSAPublicKey"); key != "" {
+		m.Properties.LinuxProfile.SSH.PublicKeys = []sshKey{{KeyData: key}}
+	}
+
+	// acs-engine has a `<pool name>Count`, `<pool name>VMSize` and `<pool name>osType` parameter for each agent pool.
+	var pools []string
+	for k := range params {
+		if strings.HasSuffix(k, "VMSize") && k != "masterVMSize" {
+			pools = append(pools, strings.TrimSuffix(k, "VMSize"))
+		}
+	}
+	sort.Strings(pools)
+	for _, pool := range pools {
+		count, err := strconv.Atoi(param(pool + "Count"))
+		if err != nil {
+			continue
+		}
+		osType := param(pool + "osType")
+		if osType == "" {
+			osType = "Linux"
+		}
+		m.Properties.AgentPoolProfiles = append(m.Properties.AgentPoolProfiles, agentPoolProfile{
+			Name:   pool,
+			Count:  count,
+			VMSize: param(pool + "VMSize"),
+			OSType: osType,
+		})
+	}
+
+	s.DNSPrefix = m.Properties.MasterProfile.DNSPrefix
+	if s.DNSPrefix == "" {
+		s.DNSPrefix = s.ResourceGroup
+		m.Properties.MasterProfile.DNSPrefix = s.DNSPrefix
+	}
+	return s, m
+}
+
+// fetchKubeConfig gets the admin kubeconfig from a leader node over ssh.
+func fetchKubeConfig(ctx context.Context, identityFile, user, fqdn string) ([]byte, error) {
+	ssh, err := exec.LookPath("ssh")
+	if err != nil {
+		return nil, errors.Wrap(err, "error looking up ssh client location")
+	}
+
+	stdout := bytes.NewBuffer(nil)
+	stderr := bytes.NewBuffer(nil)
+	cmd := exec.CommandContext(ctx, ssh,
+		"-i", identityFile,
+		"-o", "BatchMode=yes",
+		"-o", "StrictHostKeyChecking=no",
+		user+"@"+fqdn,
+		"cat .kube/config",
+	)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return nil, errors.Wrapf(err, "error fetching kubeconfig from %s: %s", fqdn, stderr.String())
+	}
+	return stdout.Bytes(), nil
+}
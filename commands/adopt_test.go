@@ -0,0 +1,32 @@
+package commands
+
+import (
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/profiles/latest/resources/mgmt/resources"
+)
+
+func TestStateFromDeploymentPools(t *testing.T) {
+	params := map[string]interface{}{"masterVMSize": map[string]interface{}{"value": "Standard_D2_v2"}}
+	for _, p := range []struct{ name, osType string }{{"windowspool1", "Windows"}, {"linuxpool2", ""}, {"linuxpool1", "Linux"}} {
+		params[p.name+"Count"] = map[string]interface{}{"value": float64(2)}
+		params[p.name+"VMSize"] = map[string]interface{}{"value": "Standard_DS2_v2"}
+		if p.osType != "" {
+			params[p.name+"osType"] = map[string]interface{}{"value": p.osType}
+		}
+	}
+	group := "testrig-test"
+	d := resources.DeploymentExtended{Properties: &resources.DeploymentPropertiesExtended{Parameters: params}}
+
+	_, m := stateFromDeployment(resources.Group{Name: &group}, d)
+	pools := m.Properties.AgentPoolProfiles
+	expected := []struct{ name, osType string }{{"linuxpool1", "Linux"}, {"linuxpool2", "Linux"}, {"windowspool1", "Windows"}}
+	if len(pools) != len(expected) {
+		t.Fatalf("expected %d agent pools, got %d", len(expected), len(pools))
+	}
+	for i, p := range expected {
+		if pools[i].Name != p.name || pools[i].OSType != p.osType {
+			t.Errorf("expected pool %d to be %s (%s), got %s (%s)", i, p.name, p.osType, pools[i].Name, pools[i].OSType)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/containerservice/mgmt/2018-03-31/containerservice"
+	"github.com/pkg/errors"
+)
+
+// aksProvisioner provisions clusters with the managed Azure Kubernetes Service.
+// Only the parts of the model which AKS supports are used: the Kubernetes version, network plugin and a single
+// Linux agent pool. The leader nodes are managed by AKS.
+type aksProvisioner struct{}
+
+func (p *aksProvisioner) client(c *cluster) (containerservice.ManagedClustersClient, error) {
+	if FakeAzure != "" {
+		return containerservice.ManagedClustersClient{}, errors.New("aks is not supported by the fake Azure backend")
+	}
+	env, auth, err := c.azure()
+	if err != nil {
+		return containerservice.ManagedClustersClient{}, err
+	}
+	client := containerservice.NewManagedClustersClientWithBaseURI(env.ResourceManagerEndpoint, c.state.SubscriptionID)
+	client.Authorizer = auth
+	return client, nil
+}
+
+// generate converts the model to the managed cluster which is sent to AKS and writes it to `_output/managedcluster.json`.
+// The service principal is left out so no credentials are written to disk, it is added on deploy.
+func (p *aksProvisioner) generate(ctx context.Context, c *cluster) (string, error) {
+	props := c.model.Properties
+	var pools []containerservice.ManagedClusterAgentPoolProfile
+	for _, pool := range props.AgentPoolProfiles {
+		if pool.Count == 0 {
+			continue
+		}
+		if strings.ToLower(pool.OSType) == "windows" {
+			return "", errors.Errorf("agent pool %q: aks does not support Windows agent pools", pool.Name)
+		}
+		pools = append(pools, containerservice.ManagedClusterAgentPoolProfile{
+			Name:   stringPtr(pool.Name),
+			Count:  int32Ptr(pool.Count),
+			VMSize: containerservice.VMSizeTypes(pool.VMSize),
+			OsType: containerservice.Linux,
+		})
+	}
+	if len(pools) != 1 {
+		return "", errors.Errorf("aks supports exactly 1 agent pool, the cluster has %d", len(pools))
+	}
+
+	var keys []containerservice.SSHPublicKey
+	for _, k := range props.LinuxProfile.SSH.PublicKeys {
+		keys = append(keys, containerservice.SSHPublicKey{KeyData: stringPtr(k.KeyData)})
+	}
+
+	mcProps := &containerservice.ManagedClusterProperties{
+		DNSPrefix:         stringPtr(props.MasterProfile.DNSPrefix),
+		AgentPoolProfiles: &pools,
+		LinuxProfile: &containerservice.LinuxProfile{
+			AdminUsername: stringPtr(props.LinuxProfile.AdminUsername),
+			SSH:           &containerservice.SSHConfiguration{PublicKeys: &keys},
+		},
+	}
+	if v := props.OrchestratorProfile.OrchestratorRelease; v != "" {
+		mcProps.KubernetesVersion = stringPtr(v)
+	}
+	if k8s := props.OrchestratorProfile.KubernetesConfig; k8s != nil && k8s.NetworkPlugin != "" {
+		mcProps.NetworkProfile = &containerservice.NetworkProfile{NetworkPlugin: containerservice.NetworkPlugin(k8s.NetworkPlugin)}
+		// AKS only supports calico for network policy
+		if k8s.NetworkPolicy == string(containerservice.Calico) {
+			mcProps.NetworkProfile.NetworkPolicy = containerservice.Calico
+		}
+	}
+
+	mc := containerservice.ManagedCluster{
+		Location:                 stringPtr(c.state.Location),
+		ManagedClusterProperties: mcProps,
+	}
+	data, err := json.MarshalIndent(mc, "", "\t")
+	if err != nil {
+		return "", errors.Wrap(err, "error marshalling managed cluster")
+	}
+	if err := os.MkdirAll(filepath.Join(c.dir, "_output"), 0700); err != nil {
+		return "", errors.Wrap(err, "error creating output dir")
+	}
+	path := filepath.Join(c.dir, "_output", "managedcluster.json")
+	return path, errors.Wrap(ioutil.WriteFile(path, data, 0600), "error writing managed cluster")
+}
+
+func (p *aksProvisioner) deploy(ctx context.Context, c *cluster, detach bool) error {
+	data, err := ioutil.ReadFile(filepath.Join(c.dir, "_output", "managedcluster.json"))
+	if err != nil {
+		return errors.Wrap(err, "error reading managed cluster")
+	}
+	var mc containerservice.ManagedCluster
+	if err := json.Unmarshal(data, &mc); err != nil {
+		return errors.Wrap(err, "error unmarshaling managed cluster")
+	}
+	if err := setAKSServicePrincipal(&mc); err != nil {
+		return err
+	}
+
+	client, err := p.client(c)
+	if err != nil {
+		return err
+	}
+
+	s := c.state
+	if v := mc.KubernetesVersion; v != nil && strings.Count(*v, ".") < 2 {
+		version, err := latestAKSVersion(ctx, c, *v)
+		if err != nil {
+			return err
+		}
+		mc.KubernetesVersion = &version
+	}
+
+	name := c.model.Properties.MasterProfile.DNSPrefix
+	future, err := client.CreateOrUpdate(ctx, s.ResourceGroup, name, mc)
+	if err != nil {
+		return errors.Wrap(err, "error creating managed cluster")
+	}
+
+	s.DeploymentName = name
+	s.DNSPrefix = name
+	if err := c.writeState(); err != nil {
+		return err
+	}
+	if detach {
+		return nil
+	}
+
+	if err := future.WaitForCompletionRef(ctx, client.Client); err != nil {
+		return errors.Wrap(err, "error creating managed cluster")
+	}
+	mc, err = future.Result(client)
+	if err != nil {
+		return errors.Wrap(err, "error getting managed cluster")
+	}
+	if mc.ManagedClusterProperties != nil && mc.Fqdn != nil {
+		s.FQDN = *mc.Fqdn
+	}
+	return nil
+}
+
+// update applies a change to the managed cluster in Azure and waits for it to finish.
+func (p *aksProvisioner) update(ctx context.Context, c *cluster, change func(*containerservice.ManagedCluster) error) error {
+	client, err := p.client(c)
+	if err != nil {
+		return err
+	}
+
+	mc, err := client.Get(ctx, c.state.ResourceGroup, c.state.DeploymentName)
+	if err != nil {
+		return errors.Wrapf(err, "error getting managed cluster %q", c.state.DeploymentName)
+	}
+	if mc.ManagedClusterProperties == nil {
+		return errors.Errorf("managed cluster %q has no properties", c.state.DeploymentName)
+	}
+	if err := change(&mc); err != nil {
+		return err
+	}
+	if err := setAKSServicePrincipal(&mc); err != nil {
+		return err
+	}
+
+	future, err := client.CreateOrUpdate(ctx, c.state.ResourceGroup, c.state.DeploymentName, mc)
+	if err != nil {
+		return errors.Wrapf(err, "error updating managed cluster %q", c.state.DeploymentName)
+	}
+	return errors.Wrapf(future.WaitForCompletionRef(ctx, client.Client), "error updating managed cluster %q", c.state.DeploymentName)
+}
+
+func (p *aksProvisioner) scale(ctx context.Context, c *cluster, pool string, count int) error {
+	agentPool := c.model.Properties.agentPool(pool)
+	if agentPool == nil {
+		return errors.Errorf("no agent pool named %q", pool)
+	}
+
+	err := p.update(ctx, c, func(mc *containerservice.ManagedCluster) error {
+		if mc.AgentPoolProfiles != nil {
+			for i, ap := range *mc.AgentPoolProfiles {
+				if ap.Name != nil && *ap.Name == pool {
+					(*mc.AgentPoolProfiles)[i].Count = int32Ptr(count)
+					return nil
+				}
+			}
+		}
+		return errors.Errorf("no agent pool named %q in managed cluster", pool)
+	})
+	if err != nil {
+		return err
+	}
+
+	agentPool.Count = count
+	_, err = writeAPIModel(c.dir, c.model)
+	return err
+}
+
+func (p *aksProvisioner) upgrade(ctx context.Context, c *cluster, version string) error {
+	err := p.update(ctx, c, func(mc *containerservice.ManagedCluster) error {
+		mc.KubernetesVersion = stringPtr(version)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Same as the engines, the model only has the release and the patch version is resolved on deploy.
+	c.model.Properties.OrchestratorProfile.OrchestratorRelease = kubernetesRelease(version)
+	_, err = writeAPIModel(c.dir, c.model)
+	return err
+}
+
+func (p *aksProvisioner) delete(ctx context.Context, c *cluster) (groupDeleteFuture, error) {
+	// The managed cluster is in the cluster's resource group, AKS removes the node resource group along with it.
+	return deleteResourceGroup(ctx, c)
+}
+
+// kubeConfig fetches the admin kubeconfig from AKS and stores it where acs-engine would have put it.
+func (p *aksProvisioner) kubeConfig(ctx context.Context, c *cluster) (string, error) {
+	dir := filepath.Join(c.dir, "_output", "kubeconfig")
+	path := filepath.Join(dir, "kubeconfig."+c.state.Location+".json")
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+
+	client, err := p.client(c)
+	if err != nil {
+		return "", err
+	}
+	creds, err := client.ListClusterAdminCredentials(ctx, c.state.ResourceGroup, c.state.DeploymentName)
+	if err != nil {
+		return "", errors.Wrap(err, "error getting cluster credentials")
+	}
+	if creds.Kubeconfigs == nil || len(*creds.Kubeconfigs) == 0 || (*creds.Kubeconfigs)[0].Value == nil {
+		return "", errors.New("no kubeconfig returned for cluster")
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", errors.Wrap(err, "error creating kubeconfig dir")
+	}
+	if err := ioutil.WriteFile(path, *(*creds.Kubeconfigs)[0].Value, 0600); err != nil {
+		return "", errors.Wrap(err, "error writing kubeconfig")
+	}
+	return path, nil
+}
+
+// setAKSServicePrincipal sets the service principal the cluster uses to manage Azure resources, which AKS requires.
+func setAKSServicePrincipal(mc *containerservice.ManagedCluster) error {
+	clientID, secret, ok := servicePrincipal()
+	if !ok {
+		return errors.New("aks requires a service principal, set AZURE_AUTH_LOCATION or AZURE_CLIENT_ID and AZURE_CLIENT_SECRET")
+	}
+	mc.ServicePrincipalProfile = &containerservice.ManagedClusterServicePrincipalProfile{ClientID: &clientID, Secret: &secret}
+	return nil
+}
+
+// latestAKSVersion gets the newest Kubernetes version AKS supports for a release, e.g. 1.11 -> 1.11.3.
+func latestAKSVersion(ctx context.Context, c *cluster, release string) (string, error) {
+	if FakeAzure != "" {
+		return "", errors.New("aks is not supported by the fake Azure backend")
+	}
+	env, auth, err := c.azure()
+	if err != nil {
+		return "", err
+	}
+	client := containerservice.NewContainerServicesClientWithBaseURI(env.ResourceManagerEndpoint, c.state.SubscriptionID)
+	client.Authorizer = auth
+
+	result, err := client.ListOrchestrators(ctx, c.state.Location, "managedClusters")
+	if err != nil {
+		return "", errors.Wrap(err, "error listing aks versions")
+	}
+
+	var versions []string
+	if result.OrchestratorVersionProfileProperties != nil && result.Orchestrators != nil {
+		for _, o := range *result.Orchestrators {
+			if o.OrchestratorVersion != nil && strings.HasPrefix(*o.OrchestratorVersion, release+".") {
+				versions = append(versions, *o.OrchestratorVersion)
+			}
+		}
+	}
+	if len(versions) == 0 {
+		return "", errors.Errorf("aks does not support Kubernetes %s in %s", release, c.state.Location)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return patchVersion(versions[i]) < patchVersion(versions[j])
+	})
+	return versions[len(versions)-1], nil
+}
+
+func patchVersion(version string) int {
+	n, _ := strconv.Atoi(version[strings.LastIndex(version, ".")+1:])
+	return n
+}
+
+func int32Ptr(i int) *int32 {
+	v := int32(i)
+	return &v
+}
@@ -1,16 +1,22 @@
 package commands
 
 import (
+	"encoding/json"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
 
 	"github.com/Azure/go-autorest/autorest"
 	"github.com/Azure/go-autorest/autorest/azure"
 	"github.com/Azure/go-autorest/autorest/azure/auth"
+	homedir "github.com/mitchellh/go-homedir"
 	"github.com/pkg/errors"
 	ini "gopkg.in/ini.v1"
 )
 
+const defaultAzCloud = "AzureCloud"
+
 func getSubFromAzDir(root string) (string, error) {
 	subConfig, err := ini.Load(filepath.Join(root, "clouds.config"))
 	if err != nil {
@@ -26,8 +32,42 @@ func getSubFromAzDir(root string) (string, error) {
 	return getCloudSubFromAzConfig(cloud, subConfig)
 }
 
+// resolveSubscription returns the subscription to use for Azure operations.
+// The passed in subscription (usually from a flag) is preferred, then the user config, then the azure CLI config.
+func resolveSubscription(subscriptionID string, cfg *UserConfig) (string, error) {
+	if subscriptionID != "" {
+		return subscriptionID, nil
+	}
+	if cfg != nil && cfg.Subscription != "" {
+		return cfg.Subscription, nil
+	}
+
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", errors.Wrap(err, "error determining home dir while trying to infer subscription ID")
+	}
+	subscriptionID, err = getSubFromAzDir(filepath.Join(home, ".azure"))
+	if err != nil {
+		return "", errors.Wrap(err, "no subscription provided and could not determine from azure CLI dir")
+	}
+	return subscriptionID, nil
+}
+
+// selectedAzCloud gets the name of the cloud selected in the azure CLI config, e.g. "AzureCloud".
+func selectedAzCloud() string {
+	home, err := homedir.Dir()
+	if err != nil {
+		return defaultAzCloud
+	}
+	f, err := ini.Load(filepath.Join(home, ".azure", "config"))
+	if err != nil {
+		return defaultAzCloud
+	}
+	return getSelectedCloudFromAzConfig(f)
+}
+
 func getSelectedCloudFromAzConfig(f *ini.File) string {
-	selectedCloud := "AzureCloud"
+	selectedCloud := defaultAzCloud
 	if cloud, err := f.GetSection("cloud"); err == nil {
 		if name, err := cloud.GetKey("name"); err == nil {
 			if s := name.String(); s != "" {
@@ -50,18 +90,60 @@ func getCloudSubFromAzConfig(cloud string, f *ini.File) (string, error) {
 	return sub.String(), nil
 }
 
-func getAuthorizer() (autorest.Authorizer, error) {
+var (
+	authorizersMu sync.Mutex
+	// authorizers caches authorizers by resource manager endpoint, getting a token from the azure CLI is slow.
+	authorizers = make(map[string]autorest.Authorizer)
+)
+
+func getAuthorizer(env azure.Environment) (autorest.Authorizer, error) {
+	authorizersMu.Lock()
+	defer authorizersMu.Unlock()
+
+	if authorizer, ok := authorizers[env.ResourceManagerEndpoint]; ok {
+		return authorizer, nil
+	}
+
+	var (
+		authorizer autorest.Authorizer
+		err        error
+	)
 	if os.Getenv("AZURE_AUTH_LOCATION") != "" {
-		authorizer, err := auth.NewAuthorizerFromFile(azure.PublicCloud.ResourceManagerEndpoint)
+		authorizer, err = auth.NewAuthorizerFromFile(env.ResourceManagerEndpoint)
 		if err != nil {
 			return nil, errors.Wrap(err, "error reading auth file")
 		}
-		return authorizer, nil
+	} else {
+		authorizer, err = auth.NewAuthorizerFromCLIWithResource(env.ResourceManagerEndpoint)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not get authorizer from azure CLI or environment")
+		}
+	}
+	authorizers[env.ResourceManagerEndpoint] = authorizer
+	return authorizer, nil
+}
+
+// servicePrincipal gets the credentials of the service principal testrig is authenticated with, if any.
+// These are read from the AZURE_AUTH_LOCATION file, or the AZURE_CLIENT_ID and AZURE_CLIENT_SECRET environment variables.
+func servicePrincipal() (clientID, secret string, ok bool) {
+	if clientID, secret := os.Getenv("AZURE_CLIENT_ID"), os.Getenv("AZURE_CLIENT_SECRET"); clientID != "" && secret != "" {
+		return clientID, secret, true
 	}
 
-	authorizer, err := auth.NewAuthorizerFromCLI()
+	authFile := os.Getenv("AZURE_AUTH_LOCATION")
+	if authFile == "" {
+		return "", "", false
+	}
+	data, err := ioutil.ReadFile(authFile)
 	if err != nil {
-		return nil, errors.Wrap(err, "could not get authorizer from azure CLI or environment")
+		return "", "", false
 	}
-	return authorizer, nil
+	var f struct {
+		ClientID     string `json:"clientId"`
+		ClientSecret string `json:"clientSecret"`
+	}
+	if err := json.Unmarshal(data, &f); err != nil || f.ClientID == "" || f.ClientSecret == "" {
+		return "", "", false
+	}
+	return f.ClientID, f.ClientSecret, true
 }
@@ -0,0 +1,230 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/Azure/azure-sdk-for-go/profiles/latest/resources/mgmt/resources"
+	"github.com/pkg/errors"
+)
+
+// FakeAzure is the directory the fake Azure backend keeps its state in, see fakeBackend.
+// When empty the real Azure APIs are used.
+var FakeAzure string
+
+// groupsClient is the subset of the resource group API used by testrig.
+type groupsClient interface {
+	Get(ctx context.Context, name string) (resources.Group, error)
+	CreateOrUpdate(ctx context.Context, name string, group resources.Group) (resources.Group, error)
+	// Delete starts deleting the resource group and everything in it, use the returned future to wait for it to finish.
+	Delete(ctx context.Context, name string) (groupDeleteFuture, error)
+	// ResumeDelete gets the future for a deletion saved from a previous Delete, see groupDeleteFuture.
+	ResumeDelete(saved json.RawMessage) (groupDeleteFuture, error)
+	Exists(ctx context.Context, name string) (bool, error)
+	// ListByTag lists the resource groups which have the tag set, with any value.
+	ListByTag(ctx context.Context, tag string) ([]resources.Group, error)
+}
+
+// deploymentsClient is the subset of the ARM deployment API used by testrig.
+type deploymentsClient interface {
+	// CreateOrUpdate submits the deployment, use the returned future to wait for it to finish.
+	CreateOrUpdate(ctx context.Context, group, name string, deployment resources.Deployment) (deploymentFuture, error)
+	Get(ctx context.Context, group, name string) (resources.DeploymentExtended, error)
+	List(ctx context.Context, group string) ([]resources.DeploymentExtended, error)
+	ListOperations(ctx context.Context, group, name string) ([]resources.DeploymentOperation, error)
+}
+
+type deploymentFuture interface {
+	// Wait waits for the deployment to finish and gets the result.
+	Wait(ctx context.Context) (resources.DeploymentExtended, error)
+}
+
+type groupDeleteFuture interface {
+	// Wait waits for the resource group to be deleted.
+	Wait(ctx context.Context) error
+	// Done checks once if the resource group has been deleted, the error is set if the deletion failed.
+	Done(ctx context.Context) (bool, error)
+	// The future is saved as JSON, this includes the URL to poll for the status of the deletion.
+	json.Marshaler
+}
+
+// azureBackend creates the clients for the subscription and cloud of a cluster.
+type azureBackend interface {
+	groups(s state) (groupsClient, error)
+	deployments(s state) (deploymentsClient, error)
+}
+
+// newBackend gets the backend selected with FakeAzure.
+func newBackend() azureBackend {
+	if FakeAzure != "" {
+		return &fakeBackend{dir: FakeAzure}
+	}
+	return armBackend{}
+}
+
+// armBackend uses the real Azure resource manager APIs.
+type armBackend struct{}
+
+func (armBackend) groups(s state) (groupsClient, error) {
+	env, err := s.environment()
+	if err != nil {
+		return nil, err
+	}
+	auth, err := getAuthorizer(env)
+	if err != nil {
+		return nil, err
+	}
+	client := resources.NewGroupsClientWithBaseURI(env.ResourceManagerEndpoint, s.SubscriptionID)
+	client.Authorizer = auth
+	return armGroups{client}, nil
+}
+
+func (armBackend) deployments(s state) (deploymentsClient, error) {
+	env, err := s.environment()
+	if err != nil {
+		return nil, err
+	}
+	auth, err := getAuthorizer(env)
+	if err != nil {
+		return nil, err
+	}
+	client := resources.NewDeploymentsClientWithBaseURI(env.ResourceManagerEndpoint, s.SubscriptionID)
+	client.Authorizer = auth
+	ops := resources.NewDeploymentOperationsClientWithBaseURI(env.ResourceManagerEndpoint, s.SubscriptionID)
+	ops.Authorizer = auth
+	return armDeployments{client: client, ops: ops}, nil
+}
+
+type armGroups struct {
+	client resources.GroupsClient
+}
+
+func (g armGroups) Get(ctx context.Context, name string) (resources.Group, error) {
+	return g.client.Get(ctx, name)
+}
+
+func (g armGroups) CreateOrUpdate(ctx context.Context, name string, group resources.Group) (resources.Group, error) {
+	return g.client.CreateOrUpdate(ctx, name, group)
+}
+
+func (g armGroups) Delete(ctx context.Context, name string) (groupDeleteFuture, error) {
+	future, err := g.client.Delete(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return &armGroupDeleteFuture{future: future, client: g.client}, nil
+}
+
+func (g armGroups) ResumeDelete(saved json.RawMessage) (groupDeleteFuture, error) {
+	var future resources.GroupsDeleteFuture
+	if err := json.Unmarshal(saved, &future); err != nil {
+		return nil, errors.Wrap(err, "error decoding saved resource group deletion")
+	}
+	return &armGroupDeleteFuture{future: future, client: g.client}, nil
+}
+
+func (g armGroups) Exists(ctx context.Context, name string) (bool, error) {
+	resp, err := g.client.CheckExistence(ctx, name)
+	if err != nil {
+		if isAzureNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return resp.StatusCode != http.StatusNotFound, nil
+}
+
+func (g armGroups) ListByTag(ctx context.Context, tag string) ([]resources.Group, error) {
+	iter, err := g.client.ListComplete(ctx, "tagName eq '"+tag+"'", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []resources.Group
+	for iter.NotDone() {
+		groups = append(groups, iter.Value())
+		if err := iter.Next(); err != nil {
+			return nil, err
+		}
+	}
+	return groups, nil
+}
+
+type armGroupDeleteFuture struct {
+	future resources.GroupsDeleteFuture
+	client resources.GroupsClient
+}
+
+func (f *armGroupDeleteFuture) Wait(ctx context.Context) error {
+	return f.future.WaitForCompletionRef(ctx, f.client.Client)
+}
+
+func (f *armGroupDeleteFuture) Done(ctx context.Context) (bool, error) {
+	return f.future.Done(f.client)
+}
+
+func (f *armGroupDeleteFuture) MarshalJSON() ([]byte, error) {
+	return f.future.MarshalJSON()
+}
+
+type armDeployments struct {
+	client resources.DeploymentsClient
+	ops    resources.DeploymentOperationsClient
+}
+
+func (d armDeployments) CreateOrUpdate(ctx context.Context, group, name string, deployment resources.Deployment) (deploymentFuture, error) {
+	future, err := d.client.CreateOrUpdate(ctx, group, name, deployment)
+	if err != nil {
+		return nil, err
+	}
+	return armDeploymentFuture{future: future, client: d.client}, nil
+}
+
+func (d armDeployments) Get(ctx context.Context, group, name string) (resources.DeploymentExtended, error) {
+	return d.client.Get(ctx, group, name)
+}
+
+func (d armDeployments) List(ctx context.Context, group string) ([]resources.DeploymentExtended, error) {
+	iter, err := d.client.ListByResourceGroupComplete(ctx, group, "", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var deployments []resources.DeploymentExtended
+	for iter.NotDone() {
+		deployments = append(deployments, iter.Value())
+		if err := iter.Next(); err != nil {
+			return nil, err
+		}
+	}
+	return deployments, nil
+}
+
+func (d armDeployments) ListOperations(ctx context.Context, group, name string) ([]resources.DeploymentOperation, error) {
+	iter, err := d.ops.ListComplete(ctx, group, name, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var ops []resources.DeploymentOperation
+	for iter.NotDone() {
+		ops = append(ops, iter.Value())
+		if err := iter.Next(); err != nil {
+			return nil, err
+		}
+	}
+	return ops, nil
+}
+
+type armDeploymentFuture struct {
+	future resources.DeploymentsCreateOrUpdateFuture
+	client resources.DeploymentsClient
+}
+
+func (f armDeploymentFuture) Wait(ctx context.Context) (resources.DeploymentExtended, error) {
+	if err := f.future.WaitForCompletionRef(ctx, f.client.Client); err != nil {
+		return resources.DeploymentExtended{}, err
+	}
+	return f.future.Result(f.client)
+}
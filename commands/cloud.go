@@ -0,0 +1,96 @@
+package commands
+
+import (
+	"os"
+	"strings"
+
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/pkg/errors"
+)
+
+// knownClouds maps the cloud names used by the azure CLI to their environments.
+// The names used by go-autorest (e.g. "AzurePublicCloud") and the short aliases are accepted as well.
+var knownClouds = []struct {
+	name    string
+	aliases []string
+	env     azure.Environment
+}{
+	{name: "AzureCloud", aliases: []string{"public"}, env: azure.PublicCloud},
+	{name: "AzureChinaCloud", aliases: []string{"china"}, env: azure.ChinaCloud},
+	{name: "AzureUSGovernment", aliases: []string{"usgovernment"}, env: azure.USGovernmentCloud},
+	{name: "AzureGermanCloud", aliases: []string{"german"}, env: azure.GermanCloud},
+}
+
+// lookupCloud gets the environment for a cloud.
+// The cloud is either the name of a well known cloud or the path to a JSON file describing a custom environment.
+// For well known clouds the name is normalized to the one used by the azure CLI, the returned environment is nil.
+// For custom clouds the environment must be stored with the cluster since the file may not be around later.
+func lookupCloud(cloud string) (string, *azure.Environment, error) {
+	for _, c := range knownClouds {
+		if strings.EqualFold(cloud, c.name) || strings.EqualFold(cloud, c.env.Name) {
+			return c.name, nil, nil
+		}
+		for _, a := range c.aliases {
+			if strings.EqualFold(cloud, a) {
+				return c.name, nil, nil
+			}
+		}
+	}
+
+	if _, err := os.Stat(cloud); err != nil {
+		return "", nil, errors.Errorf("unknown cloud %q, must be one of AzureCloud, AzureChinaCloud, AzureUSGovernment, AzureGermanCloud or the path to an environment file", cloud)
+	}
+	env, err := azure.EnvironmentFromFile(cloud)
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "error reading cloud environment file %q", cloud)
+	}
+	if env.ResourceManagerEndpoint == "" {
+		return "", nil, errors.Errorf("cloud environment file %q is missing the resource manager endpoint", cloud)
+	}
+	if env.Name == "" {
+		env.Name = "AzureStackCloud"
+	}
+	return env.Name, &env, nil
+}
+
+// resolveCloud returns the cloud to use for Azure operations.
+// The passed in cloud (usually from a flag) is preferred, then the user config, then the azure CLI config.
+func resolveCloud(cloud string, cfg *UserConfig) (string, *azure.Environment, error) {
+	if cloud == "" && cfg != nil {
+		cloud = cfg.Cloud
+	}
+	if cloud == "" {
+		cloud = selectedAzCloud()
+	}
+	return lookupCloud(cloud)
+}
+
+// setModelCloud sets the location of the cluster in the model, which acs-engine uses to pick the endpoints of
+// well known clouds. Custom clouds have their environment passed along explicitly.
+func setModelCloud(m *apiModel, location string, custom *azure.Environment) {
+	m.Location = location
+	if custom != nil {
+		m.Properties.CustomCloudProfile = &customCloudProfile{Environment: custom}
+	}
+}
+
+// environment gets the Azure environment for the cloud the cluster was deployed to.
+func (s state) environment() (azure.Environment, error) {
+	return cloudEnvironment(s.Cloud, s.CloudEnvironment)
+}
+
+// cloudEnvironment gets the environment for a cloud name returned by lookupCloud.
+func cloudEnvironment(name string, custom *azure.Environment) (azure.Environment, error) {
+	if custom != nil {
+		return *custom, nil
+	}
+	if name == "" {
+		return azure.PublicCloud, nil
+	}
+	for _, c := range knownClouds {
+		if c.name == name {
+			return c.env, nil
+		}
+	}
+	return azure.Environment{}, errors.Errorf("unknown cloud %q", name)
+}
@@ -12,28 +12,43 @@ import (
 type UserConfig struct {
 	Subscription string
 	Location     string
+	// Cloud is the name of the Azure cloud or the path to a custom environment file
+	Cloud string
+	// Provisioner is the provisioner clusters are created with by default, see create --provisioner
+	Provisioner string
+	// Tags are added to the resource group of every cluster
+	Tags map[string]string
 
-	Profile struct {
-		KubernetesVersion string
-		Leader            struct {
-			Linux struct {
-				SKU   string
-				Count *int
-			}
+	// DefaultProfile is the name of the profile from Profiles used when no profile is selected.
+	DefaultProfile string
+	// Profile holds the settings which apply to every cluster, named profiles are applied on top of it.
+	Profile  Profile
+	Profiles map[string]Profile
+}
+
+// Profile is a set of cluster settings used to override the defaults.
+// It's used by UserConfig
+type Profile struct {
+	KubernetesVersion string
+	Leader            struct {
+		Linux struct {
+			SKU   string
+			Count *int
 		}
-		Agent struct {
-			Linux   AgentNodeConfig
-			Windows AgentNodeConfig
+	}
+	Agent struct {
+		Linux   AgentNodeConfig
+		Windows AgentNodeConfig
+		Pools   []AgentPoolConfig
+	}
+	Auth struct {
+		Linux struct {
+			User          string
+			PublicKeyFile string
 		}
-		Auth struct {
-			Linux struct {
-				User          string
-				PublicKeyFile string
-			}
-			Windows struct {
-				User         string
-				PasswordFile string
-			}
+		Windows struct {
+			User         string
+			PasswordFile string
 		}
 	}
 }
@@ -45,6 +60,16 @@ type AgentNodeConfig struct {
 	Count *int
 }
 
+// AgentPoolConfig is used to add a named agent pool, or to override the settings of an existing pool with the same name.
+// It's used by UserConfig and the `--pool` flag of `create`
+type AgentPoolConfig struct {
+	Name                string
+	OS                  string
+	SKU                 string
+	Count               *int
+	AvailabilityProfile string
+}
+
 // ReadUserConfig reads the config from the provided path
 // If
 func ReadUserConfig(configPath string) (UserConfig, error) {
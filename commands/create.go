@@ -1,27 +1,28 @@
 package commands
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"io"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 	"time"
 
-	"github.com/Azure/azure-sdk-for-go/profiles/latest/resources/mgmt/resources"
-	homedir "github.com/mitchellh/go-homedir"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/cpuguy83/strongerrors"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 // Create creates the `create` subcommand.
 func Create(ctx context.Context, stateDir string, cfg *UserConfig) *cobra.Command {
+	// The flags are bound to a model built from the default profile so the defaults shown in the help output are accurate.
+	// If a different profile is selected, the model is rebuilt when the command is run.
 	m := defaultModel()
-	configErr := overrideModelDefaults(m, cfg)
+	configErr := overrideModelDefaults(m, cfg, cfg.DefaultProfile)
 	var opts createOpts
 
 	cmd := &cobra.Command{
@@ -29,34 +30,79 @@ func Create(ctx context.Context, stateDir string, cfg *UserConfig) *cobra.Comman
 		Short: "Create a new kubernetes cluster on Azure",
 		Args:  cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			if configErr != nil {
+			// A broken default profile only matters when it is the one being used.
+			if configErr != nil && opts.APIModelPath == "" && opts.Profile == cfg.DefaultProfile {
 				return configErr
 			}
-			if _, err := os.Stat(opts.ACSEnginePath); err != nil && os.IsNotExist(err) {
-				var err2 error
-				if opts.ACSEnginePath, err2 = exec.LookPath(opts.ACSEnginePath); err2 != nil {
-					return errors.New("could not find acs-engine binary")
-				}
+			if opts.DryRun && (opts.Resume || opts.Detach) {
+				return errors.New("--dry-run cannot be used with --resume or --detach")
+			}
+			var err error
+			opts.Cloud, opts.CloudEnvironment, err = resolveCloud(opts.Cloud, cfg)
+			if err != nil {
+				return err
 			}
 
-			if opts.SubscriptionID == "" {
-				opts.SubscriptionID = cfg.Subscription
-				if opts.SubscriptionID == "" {
-					home, err := homedir.Dir()
-					if err != nil {
-						return errors.Wrap(err, "error determining home dir while trying to infer subscription ID")
-					}
-					opts.SubscriptionID, err = getSubFromAzDir(filepath.Join(home, ".azure"))
-					if err != nil {
-						return errors.Wrap(err, "no subscription provided and could not determine from azure CLI dir")
-					}
+			opts.StateDir = stateDir
+			if opts.Resume {
+				subscriptionID := opts.SubscriptionID
+				return runResume(ctx, args[0], opts, func() (string, error) {
+					return resolveSubscription(subscriptionID, cfg)
+				}, cmd.OutOrStderr())
+			}
+
+			if !opts.DryRun {
+				opts.SubscriptionID, err = resolveSubscription(opts.SubscriptionID, cfg)
+				if err != nil {
+					return err
 				}
 			}
 
 			if opts.Location == "" {
 				opts.Location = cfg.Location
 			}
-			opts.StateDir = stateDir
+
+			tags := make(map[string]string, len(cfg.Tags)+len(opts.Tags))
+			for k, v := range cfg.Tags {
+				tags[k] = v
+			}
+			for k, v := range opts.Tags {
+				tags[k] = v
+			}
+			if err := validateTags(tags); err != nil {
+				return err
+			}
+			opts.Tags = tags
+
+			m := m
+			switch {
+			case opts.APIModelPath != "":
+				um, err := loadAPIModel(opts.APIModelPath)
+				if err != nil {
+					return err
+				}
+				applyModelFlags(cmd.Flags(), um, m)
+				m = um
+			case opts.Profile != cfg.DefaultProfile:
+				pm := defaultModel()
+				if err := overrideModelDefaults(pm, cfg, opts.Profile); err != nil {
+					return err
+				}
+				applyModelFlags(cmd.Flags(), pm, m)
+				m = pm
+			}
+
+			for _, pool := range opts.Pools {
+				if err := setAgentPool(m, pool); err != nil {
+					return err
+				}
+			}
+			if opts.ModelPatchPath != "" {
+				if err := applyModelPatch(m, opts.ModelPatchPath); err != nil {
+					return err
+				}
+			}
+
 			opts.Model = m
 
 			return runCreate(ctx, args[0], opts, os.Stdin, cmd.OutOrStdout(), cmd.OutOrStderr())
@@ -64,23 +110,42 @@ func Create(ctx context.Context, stateDir string, cfg *UserConfig) *cobra.Comman
 	}
 
 	flags := cmd.Flags()
-	flags.StringVar(&opts.ACSEnginePath, "acs-engine-path", "acs-engine", "Location of acs-engine binary")
+	opts.Engines.addFlags(flags)
+	provisioner := cfg.Provisioner
+	if provisioner == "" {
+		provisioner = provisionerACSEngine
+	}
+	flags.StringVar(&opts.Provisioner, "provisioner", provisioner, "How to provision the cluster, one of: acs-engine, aks-engine, aks")
 
 	// TODO(@cpuguy83): Configure this through some default config in the state dir
 	flags.StringVarP(&opts.Location, "location", "l", cfg.Location, "Azure location to deploy to, e.g. `centralus` (required)")
 	flags.StringVarP(&opts.SubscriptionID, "subscription", "s", "", "Azure subscription to deploy the cluster with")
+	flags.StringVar(&opts.Cloud, "cloud", "", "Azure cloud to deploy to (AzureCloud, AzureChinaCloud, AzureUSGovernment, AzureGermanCloud or the path to a custom environment file), defaults to the cloud selected in the azure CLI")
+	flags.StringVar(&opts.Profile, "profile", cfg.DefaultProfile, "Named profile from the user config to create the cluster with")
+	flags.StringVar(&opts.APIModelPath, "api-model", "", "Path to a full acs-engine API model to create the cluster from instead of the defaults and user config")
+	flags.StringVar(&opts.ModelPatchPath, "model-patch", "", "Path to a JSON merge patch to apply to the API model")
+	flags.DurationVar(&opts.TTL, "ttl", 0, "Time after which the cluster is considered expired and will be removed by \"testrig gc\", e.g. 8h")
+	flags.StringToStringVar(&opts.Tags, "tag", nil, "Tag to add to the cluster's resource group as key=value, in addition to the tags from the user config (can be repeated)")
+	flags.BoolVar(&opts.Resume, "resume", false, "Resume creating an existing cluster which failed or was interrupted, using its stored configuration")
+	flags.BoolVarP(&opts.Detach, "detach", "d", false, "Return as soon as the deployment has been submitted to Azure, see \"testrig wait\"")
+	flags.DurationVar(&opts.ReadyTimeout, "ready-timeout", 20*time.Minute, "Maximum amount of time to wait for Kubernetes to be ready once the cluster is deployed, 0 skips waiting")
+	flags.BoolVar(&opts.DryRun, "dry-run", false, "Generate the deployment and print what would be created without deploying anything to Azure")
 
 	p := m.Properties
 	flags.IntVar(&p.MasterProfile.Count, "linux-leader-count", p.MasterProfile.Count, "Number of nodes for the Kubernetes leader pool")
 	flags.StringVar(&p.MasterProfile.VMSize, "linux-leader-node-sku", p.MasterProfile.VMSize, "VM SKU for leader nodes")
 
-	flags.IntVar(&p.AgentPoolProfiles[0].Count, "linux-agent-count", p.AgentPoolProfiles[0].Count, "Number of Linux nodes for the Kubernetes agent/worker pools")
-	flags.StringVar(&p.AgentPoolProfiles[0].VMSize, "linux-agent-node-sku", p.AgentPoolProfiles[0].VMSize, "VM SKU for Linux agent nodes")
-	flags.StringVar(&p.AgentPoolProfiles[0].AvailabilityProfile, "linux-agent-availability-profile", p.AgentPoolProfiles[0].AvailabilityProfile, "Availabiltiy profile for Linux agent nodes")
+	linuxPool := p.agentPool(defaultLinuxPool)
+	flags.IntVar(&linuxPool.Count, "linux-agent-count", linuxPool.Count, "Number of Linux nodes for the Kubernetes agent/worker pools")
+	flags.StringVar(&linuxPool.VMSize, "linux-agent-node-sku", linuxPool.VMSize, "VM SKU for Linux agent nodes")
+	flags.StringVar(&linuxPool.AvailabilityProfile, "linux-agent-availability-profile", linuxPool.AvailabilityProfile, "Availabiltiy profile for Linux agent nodes")
+
+	windowsPool := p.agentPool(defaultWindowsPool)
+	flags.IntVar(&windowsPool.Count, "windows-agent-count", windowsPool.Count, "Number of Windows nodes for the Kubernetes agent/worker pools")
+	flags.StringVar(&windowsPool.VMSize, "windows-agent-node-sku", windowsPool.VMSize, "VM SKU for Windows agent nodes")
+	flags.StringVar(&windowsPool.AvailabilityProfile, "windows-agent-availability-profile", windowsPool.AvailabilityProfile, "Availabiltiy profile for Windows agent nodes")
 
-	flags.IntVar(&p.AgentPoolProfiles[1].Count, "windows-agent-count", p.AgentPoolProfiles[1].Count, "Number of Windows nodes for the Kubernetes agent/worker pools")
-	flags.StringVar(&p.AgentPoolProfiles[1].VMSize, "windows-agent-node-sku", p.AgentPoolProfiles[1].VMSize, "VM SKU for Windows agent nodes")
-	flags.StringVar(&p.AgentPoolProfiles[1].AvailabilityProfile, "windows-agent-availability-profile", p.AgentPoolProfiles[1].AvailabilityProfile, "Availabiltiy profile for Windows agent nodes")
+	flags.Var(&opts.Pools, "pool", "Add an agent pool, or override an existing one by name, e.g. name=pool2,os=linux,count=2,sku=Standard_DS2_v2 (can be repeated)")
 
 	flags.StringVar(&p.OrchestratorProfile.KubernetesConfig.ContainerRuntime, "runtime", p.OrchestratorProfile.KubernetesConfig.ContainerRuntime, "Container runtime to use")
 	flags.StringVar(&p.OrchestratorProfile.KubernetesConfig.NetworkPlugin, "network-plugin", p.OrchestratorProfile.KubernetesConfig.NetworkPlugin, "Network plugin to use for the cluster")
@@ -97,33 +162,97 @@ func Create(ctx context.Context, stateDir string, cfg *UserConfig) *cobra.Comman
 type createOpts struct {
 	StateDir       string
 	Model          *apiModel
-	ACSEnginePath  string
+	Engines        enginePaths
+	Provisioner    string
 	Location       string
 	SubscriptionID string
-	ResourceGroup  string
+	Cloud          string
+	// CloudEnvironment is only set for custom clouds
+	CloudEnvironment *azure.Environment
+	ResourceGroup    string
+	DryRun           bool
+	Resume           bool
+	Detach           bool
+	ReadyTimeout     time.Duration
+	Pools            agentPoolsFlag
+	Profile          string
+	APIModelPath     string
+	ModelPatchPath   string
+	TTL              time.Duration
+	Tags             map[string]string
 }
 
-func runCreate(ctx context.Context, name string, opts createOpts, in io.Reader, outW, errW io.Writer) (retErr error) {
-	var deletePools []int
-	for i, p := range opts.Model.Properties.AgentPoolProfiles {
-		if p.Count == 0 {
-			deletePools = append(deletePools, i)
+// applyModelFlags sets the values of the model flags which were explicitly set on dst.
+// The flag values are read from flagModel, which is the model the flags were bound to.
+func applyModelFlags(flags *pflag.FlagSet, dst, flagModel *apiModel) {
+	flags.Visit(func(f *pflag.Flag) {
+		if set, ok := modelFlags[f.Name]; ok {
+			set(dst.Properties, flagModel.Properties)
+		}
+	})
+}
+
+// poolFlag creates a model flag setter for one of the default agent pools.
+// Nothing is set if the pool is not in the destination model, which can happen with a user supplied API model.
+func poolFlag(name string, set func(dst, src *agentPoolProfile)) func(dst, src *properties) {
+	return func(dst, src *properties) {
+		if pool := dst.agentPool(name); pool != nil {
+			set(pool, src.agentPool(name))
 		}
 	}
+}
 
-	for n, i := range deletePools {
-		opts.Model.Properties.AgentPoolProfiles = append(opts.Model.Properties.AgentPoolProfiles[:i-n], opts.Model.Properties.AgentPoolProfiles[i-n+1:]...)
+// modelFlags copies the value set by a `create` flag from one model to another, keyed by flag name.
+// This is used to apply flags on top of a model built from a profile selected at run time.
+var modelFlags = map[string]func(dst, src *properties){
+	"linux-leader-count":                 func(dst, src *properties) { dst.MasterProfile.Count = src.MasterProfile.Count },
+	"linux-leader-node-sku":              func(dst, src *properties) { dst.MasterProfile.VMSize = src.MasterProfile.VMSize },
+	"linux-agent-count":                  poolFlag(defaultLinuxPool, func(dst, src *agentPoolProfile) { dst.Count = src.Count }),
+	"linux-agent-node-sku":               poolFlag(defaultLinuxPool, func(dst, src *agentPoolProfile) { dst.VMSize = src.VMSize }),
+	"linux-agent-availability-profile":   poolFlag(defaultLinuxPool, func(dst, src *agentPoolProfile) { dst.AvailabilityProfile = src.AvailabilityProfile }),
+	"windows-agent-count":                poolFlag(defaultWindowsPool, func(dst, src *agentPoolProfile) { dst.Count = src.Count }),
+	"windows-agent-node-sku":             poolFlag(defaultWindowsPool, func(dst, src *agentPoolProfile) { dst.VMSize = src.VMSize }),
+	"windows-agent-availability-profile": poolFlag(defaultWindowsPool, func(dst, src *agentPoolProfile) { dst.AvailabilityProfile = src.AvailabilityProfile }),
+	"runtime": func(dst, src *properties) {
+		dst.OrchestratorProfile.KubernetesConfig.ContainerRuntime = src.OrchestratorProfile.KubernetesConfig.ContainerRuntime
+	},
+	"network-plugin": func(dst, src *properties) {
+		dst.OrchestratorProfile.KubernetesConfig.NetworkPlugin = src.OrchestratorProfile.KubernetesConfig.NetworkPlugin
+	},
+	"network-policy": func(dst, src *properties) {
+		dst.OrchestratorProfile.KubernetesConfig.NetworkPolicy = src.OrchestratorProfile.KubernetesConfig.NetworkPolicy
+	},
+	"kubernetes-version": func(dst, src *properties) {
+		dst.OrchestratorProfile.OrchestratorRelease = src.OrchestratorProfile.OrchestratorRelease
+	},
+	"user":    func(dst, src *properties) { dst.LinuxProfile.AdminUsername = src.LinuxProfile.AdminUsername },
+	"ssh-key": func(dst, src *properties) { dst.LinuxProfile.SSH = src.LinuxProfile.SSH },
+}
+
+func runCreate(ctx context.Context, name string, opts createOpts, in io.Reader, outW, errW io.Writer) (retErr error) {
+	if err := pruneAgentPools(opts.Model); err != nil {
+		return err
 	}
 
-	if len(opts.Model.Properties.AgentPoolProfiles) == 0 {
-		return errors.New("must have at least 1 agent node")
+	p, err := newProvisioner(opts.Provisioner, opts.Engines)
+	if err != nil {
+		return err
 	}
 
-	var s state
+	if opts.DryRun {
+		return runCreatePlan(ctx, name, opts, p, outW)
+	}
+
+	var (
+		s       state
+		created bool
+	)
 	dir := filepath.Join(opts.StateDir, name)
 
 	defer func() {
-		if retErr == nil {
+		// Only record failures for the cluster created here, not one which already existed.
+		// A cluster which was deployed stays provisioned, provisionCluster records why Kubernetes is not ready.
+		if retErr == nil || !created || s.Status == stateProvisioned {
 			return
 		}
 
@@ -142,23 +271,32 @@ func runCreate(ctx context.Context, name string, opts createOpts, in io.Reader,
 		return errors.Wrap(err, "error creating state dir")
 	}
 
-	random, err := generateRandom()
+	dnsName, err := makeDNSPrefix(name)
 	if err != nil {
 		return err
 	}
-
-	dnsName := name + "-" + random
 	opts.Model.Properties.MasterProfile.DNSPrefix = dnsName
+	setModelCloud(opts.Model, opts.Location, opts.CloudEnvironment)
 
 	if opts.ResourceGroup == "" {
 		opts.ResourceGroup = dnsName
 	}
 
 	s = state{
-		Status:        stateInitialized,
-		Location:      opts.Location,
-		ResourceGroup: opts.ResourceGroup,
-		CreatedAt:     time.Now(),
+		Status:           stateInitialized,
+		SubscriptionID:   opts.SubscriptionID,
+		Cloud:            opts.Cloud,
+		CloudEnvironment: opts.CloudEnvironment,
+		Location:         opts.Location,
+		ResourceGroup:    opts.ResourceGroup,
+		Provisioner:      opts.Provisioner,
+		CreatedAt:        time.Now(),
+		CreatedBy:        currentUser(),
+		Tags:             opts.Tags,
+	}
+	if opts.TTL > 0 {
+		expiresAt := s.CreatedAt.Add(opts.TTL)
+		s.ExpiresAt = &expiresAt
 	}
 
 	if _, err := os.Stat(dir); err == nil {
@@ -168,118 +306,304 @@ func runCreate(ctx context.Context, name string, opts createOpts, in io.Reader,
 	if err := os.Mkdir(dir, 0700); err != nil {
 		return errors.Wrapf(err, "error creating state dir %s", dir)
 	}
+	created = true
 
 	if err := writeState(dir, s); err != nil {
 		return err
 	}
 
-	if len(opts.Model.Properties.LinuxProfile.SSH.PublicKeys) == 0 {
-		keyPath := filepath.Join(dir, "id_rsa")
-		f, err := os.OpenFile(keyPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
-		if err != nil {
-			return errors.Wrap(err, "could not create private SSH key file and no ssh keys were provided")
-		}
-		defer f.Close()
-		pubKey, err := createSSHKey(f)
-		if err != nil {
-			return errors.Wrap(err, "error creating SSH key and no SSH key was provided")
-		}
+	keyPath, err := ensureSSHKey(opts.Model, dir)
+	if err != nil {
+		return err
+	}
+	if keyPath != "" {
 		s.SSHIdentityFile = keyPath
 		if err := writeState(dir, s); err != nil {
 			return err
 		}
-		opts.Model.Properties.LinuxProfile.SSH.PublicKeys = append(opts.Model.Properties.LinuxProfile.SSH.PublicKeys, sshKey{KeyData: pubKey})
 	}
 
-	for _, p := range opts.Model.Properties.AgentPoolProfiles {
-		if p.Count > 0 {
-			switch strings.ToLower(p.OSType) {
-			case "linux":
-				// ssh key is already generated since leader nodes are linux
-			case "windows":
-				if opts.Model.Properties.WindowsProfile.AdminPassword == "" {
-					opts.Model.Properties.WindowsProfile.AdminPassword, err = generatePassword()
-					if err != nil {
-						return errors.Wrap(err, "error generating random password for Windows admin user")
-					}
-				}
-			}
+	if err := ensureWindowsPassword(opts.Model, generatePassword); err != nil {
+		return err
+	}
+
+	if _, err := writeAPIModel(dir, opts.Model); err != nil {
+		return err
+	}
+
+	return provisionCluster(ctx, &cluster{name: name, dir: dir, state: &s, model: opts.Model, errW: errW}, p, opts.Detach, opts.ReadyTimeout)
+}
+
+// provisionCluster creates the resource group for the cluster and has the provisioner generate and deploy the cluster into it.
+// Once deployed the cluster is provisioned, it is ready when Kubernetes is, see waitKubernetesReady.
+// All the operations used here are idempotent, so this can be re-run against a cluster which failed part of the
+// way through. Clusters which were already provisioned are not deployed again.
+// If Kubernetes does not become ready the cluster is left provisioned, with the reason in its failure message.
+func provisionCluster(ctx context.Context, c *cluster, p provisioner, detach bool, readyTimeout time.Duration) error {
+	s := c.state
+	if readyTimeout > 0 && !detach {
+		// Checked up front rather than finding out once the cluster has been deployed.
+		if err := checkKubectl(); err != nil {
+			return errors.Errorf("%v, use --ready-timeout=0 to skip waiting for Kubernetes to be ready", err)
+		}
+	}
+
+	if s.Status != stateProvisioned {
+		s.Status = stateCreating
+		s.FailureMessage = ""
+		s.FailureDetails = nil
+		if err := c.writeState(); err != nil {
+			return err
+		}
+
+		if _, err := p.generate(ctx, c); err != nil {
+			return err
+		}
+		if err := createResourceGroup(ctx, c); err != nil {
+			return err
+		}
+		if err := p.deploy(ctx, c, detach); err != nil {
+			return err
+		}
+		if detach {
+			return nil
+		}
+
+		s.Status = stateProvisioned
+		if err := c.writeState(); err != nil {
+			return errors.Wrap(err, "deployment succeeded but received error while writing state")
+		}
+	}
+
+	if readyTimeout > 0 {
+		if err := waitKubernetesReady(ctx, c, p, readyTimeout); err != nil {
+			s.FailureMessage = "Kubernetes is not ready: " + err.Error()
+			c.writeState()
+			return errors.Wrapf(err, "cluster was deployed but Kubernetes is not ready, use `testrig wait %s` to keep waiting", c.name)
+		}
+	}
+
+	s.Status = stateReady
+	s.FailureMessage = ""
+	if err := c.writeState(); err != nil {
+		return errors.Wrap(err, "create succeeded but received error while writing state")
+	}
+
+	return nil
+}
+
+// recordDeploymentFailures fetches the errors for the failed operations of the cluster's deployment, stores them in the state
+// and writes them out.
+// The error returned from the deployment itself is usually something generic like "DeploymentFailed".
+func recordDeploymentFailures(ctx context.Context, client deploymentsClient, s *state, errW io.Writer) {
+	failures, err := deploymentFailures(ctx, client, s.ResourceGroup, s.DeploymentName)
+	if err != nil {
+		io.WriteString(errW, err.Error()+"\n")
+		return
+	}
+	s.FailureDetails = failures
+	for _, f := range failures {
+		io.WriteString(errW, f.String()+"\n")
+	}
+}
+
+// runResume picks up a cluster which failed or was interrupted while being created.
+// The cluster is re-provisioned from the state and API model stored on disk, so any flags which alter the model are ignored.
+func runResume(ctx context.Context, name string, opts createOpts, fallbackSubscription func() (string, error), errW io.Writer) (retErr error) {
+	dir := filepath.Join(opts.StateDir, name)
+	s, err := readState(dir)
+	if err != nil {
+		if strongerrors.IsNotFound(err) {
+			return clusterNotFound(name)
 		}
+		return err
+	}
+
+	switch s.Status {
+	case stateInitialized, stateCreating, stateProvisioned, stateFailure:
+	default:
+		return errors.Errorf("cannot resume a cluster in state %q", strings.Title(string(s.Status)))
 	}
 
-	modelJSON, err := json.MarshalIndent(opts.Model, "", "\t")
+	model, err := readAPIModel(dir)
 	if err != nil {
-		return errors.Wrap(err, "error marshalling api model")
+		return err
 	}
-	modelPath := filepath.Join(dir, "apimodel.json")
-	// This file may contain a password in it, so make sure it's not readable by anyone but the user.
-	if err := ioutil.WriteFile(modelPath, modelJSON, 0600); err != nil {
-		return errors.Wrap(err, "error writing API model to disk")
+	if model.Properties == nil || model.Properties.MasterProfile == nil || model.Properties.MasterProfile.DNSPrefix == "" {
+		return errors.New("stored api model is missing the DNS prefix, cannot resume")
 	}
 
-	s.Status = stateCreating
-	if err := writeState(dir, s); err != nil {
+	if s.ResourceGroup == "" {
+		return errors.New("missing resource group in state object, cannot resume")
+	}
+
+	if _, err := clusterSubscription(dir, &s, fallbackSubscription); err != nil {
+		return err
+	}
+	p, err := newProvisioner(s.Provisioner, opts.Engines)
+	if err != nil {
 		return err
 	}
-	cmd := exec.CommandContext(ctx, opts.ACSEnginePath, "generate",
-		"--output-directory", filepath.Join(dir, "_output"),
-		"--api-model", modelPath,
-	)
 
-	buf := bytes.NewBuffer(nil)
-	cmd.Stdout = buf
-	cmd.Stderr = buf
+	defer func() {
+		if retErr == nil || s.Status == stateProvisioned {
+			return
+		}
 
-	if err := cmd.Run(); err != nil {
 		s.Status = stateFailure
-		s.FailureMessage = buf.String()
+		if s.FailureMessage == "" {
+			s.FailureMessage = retErr.Error()
+		}
 		writeState(dir, s)
-		return errors.Wrapf(err, "%s exited with error: %s", filepath.Base(opts.ACSEnginePath), s.FailureMessage)
+	}()
+
+	return provisionCluster(ctx, &cluster{name: name, dir: dir, state: &s, model: &model, errW: errW}, p, opts.Detach, opts.ReadyTimeout)
+}
+
+// planPasswordPlaceholder is used in place of a generated Windows admin password in dry runs.
+const planPasswordPlaceholder = "GENERATED-ON-CREATE"
+
+// runCreatePlan assembles the model and generates the ARM template the same way `runCreate` does,
+// but writes everything to a temp dir and prints what would be deployed instead of deploying it.
+func runCreatePlan(ctx context.Context, name string, opts createOpts, p provisioner, outW io.Writer) error {
+	if opts.Location == "" {
+		return errors.New("Must specify a location")
+	}
+	if _, err := os.Stat(filepath.Join(opts.StateDir, name)); err == nil {
+		return errors.Errorf("cluster with name %q already exists", name)
 	}
 
-	auth, err := getAuthorizer()
+	dnsName, err := makeDNSPrefix(name)
 	if err != nil {
 		return err
 	}
+	opts.Model.Properties.MasterProfile.DNSPrefix = dnsName
+	setModelCloud(opts.Model, opts.Location, opts.CloudEnvironment)
+
+	if opts.ResourceGroup == "" {
+		opts.ResourceGroup = dnsName
+	}
 
-	gClient := resources.NewGroupsClient(opts.SubscriptionID)
+	dir, err := ioutil.TempDir("", "testrig-"+name+"-")
 	if err != nil {
-		return errors.Wrap(err, "error creating resources client")
+		return errors.Wrap(err, "error creating temp dir for dry run")
 	}
 
-	gClient.Authorizer = auth
-	if _, err := gClient.CreateOrUpdate(ctx, opts.ResourceGroup, resources.Group{Location: &opts.Location, Name: &dnsName}); err != nil {
-		return errors.Wrapf(err, "error creating resource group %q", dnsName)
+	// Nothing is deployed, so placeholders are used for the credentials instead of leaving real ones in the temp dir.
+	if len(opts.Model.Properties.LinuxProfile.SSH.PublicKeys) == 0 {
+		// The private key is thrown away, the public key is only there so the template can be generated.
+		pubKey, err := createSSHKey(ioutil.Discard)
+		if err != nil {
+			return errors.Wrap(err, "error creating placeholder SSH key")
+		}
+		opts.Model.Properties.LinuxProfile.SSH.PublicKeys = append(opts.Model.Properties.LinuxProfile.SSH.PublicKeys, sshKey{KeyData: pubKey})
+	}
+	placeholderPassword := func() (string, error) { return planPasswordPlaceholder, nil }
+	if err := ensureWindowsPassword(opts.Model, placeholderPassword); err != nil {
+		return err
 	}
 
-	template, params, err := readACSDeployment(dir)
+	if _, err := writeAPIModel(dir, opts.Model); err != nil {
+		return err
+	}
+
+	s := state{Location: opts.Location, ResourceGroup: opts.ResourceGroup, Provisioner: opts.Provisioner}
+	templatePath, err := p.generate(ctx, &cluster{name: name, dir: dir, state: &s, model: opts.Model})
 	if err != nil {
 		return err
 	}
 
-	dClient := resources.NewDeploymentsClient(opts.SubscriptionID)
-	dClient.Authorizer = auth
-	future, err := dClient.CreateOrUpdate(ctx, opts.ResourceGroup, dnsName, resources.Deployment{
-		Properties: &resources.DeploymentProperties{Template: &template, Parameters: &params, Mode: resources.Incremental},
+	return writePlan(outW, plan{
+		Name:          name,
+		Location:      opts.Location,
+		ResourceGroup: opts.ResourceGroup,
+		Provisioner:   opts.Provisioner,
+		Model:         opts.Model,
+		TemplatePath:  templatePath,
 	})
-	if err != nil {
-		return errors.Wrap(err, "error creating deployment")
+}
+
+// pruneAgentPools removes any agent pools with no nodes from the model.
+func pruneAgentPools(m *apiModel) error {
+	var deletePools []int
+	for i, p := range m.Properties.AgentPoolProfiles {
+		if p.Count == 0 {
+			deletePools = append(deletePools, i)
+		}
 	}
 
-	if err := future.WaitForCompletionRef(ctx, dClient.Client); err != nil {
-		return errors.Wrap(err, "error in deployment")
+	for n, i := range deletePools {
+		m.Properties.AgentPoolProfiles = append(m.Properties.AgentPoolProfiles[:i-n], m.Properties.AgentPoolProfiles[i-n+1:]...)
 	}
-	deployment, err := future.Result(dClient)
+
+	if len(m.Properties.AgentPoolProfiles) == 0 {
+		return errors.New("must have at least 1 agent node")
+	}
+	return nil
+}
+
+func makeDNSPrefix(name string) (string, error) {
+	random, err := generateRandom()
 	if err != nil {
-		return errors.Wrap(err, "error getting deployment result")
+		return "", err
 	}
+	return name + "-" + random, nil
+}
 
-	s.DeploymentName = *deployment.Name
-	s.Status = stateReady
-	s.DNSPrefix = dnsName
-	if err := writeState(dir, s); err != nil {
-		return errors.Wrap(err, "create succeeded but received error while writing state")
+// ensureSSHKey generates an SSH key pair in dir and adds it to the model if the model does not have any public keys.
+// The returned path is the private key file, or empty if no key was generated.
+func ensureSSHKey(m *apiModel, dir string) (string, error) {
+	if len(m.Properties.LinuxProfile.SSH.PublicKeys) > 0 {
+		return "", nil
+	}
+
+	keyPath := filepath.Join(dir, "id_rsa")
+	f, err := os.OpenFile(keyPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", errors.Wrap(err, "could not create private SSH key file and no ssh keys were provided")
+	}
+	defer f.Close()
+	pubKey, err := createSSHKey(f)
+	if err != nil {
+		return "", errors.Wrap(err, "error creating SSH key and no SSH key was provided")
 	}
+	m.Properties.LinuxProfile.SSH.PublicKeys = append(m.Properties.LinuxProfile.SSH.PublicKeys, sshKey{KeyData: pubKey})
+	return keyPath, nil
+}
 
+// ensureWindowsPassword sets the Windows admin password using generate if there are Windows nodes and no password was given.
+func ensureWindowsPassword(m *apiModel, generate func() (string, error)) error {
+	for _, p := range m.Properties.AgentPoolProfiles {
+		if p.Count > 0 {
+			switch strings.ToLower(p.OSType) {
+			case "linux":
+				// ssh key is already generated since leader nodes are linux
+			case "windows":
+				if m.Properties.WindowsProfile == nil {
+					m.Properties.WindowsProfile = &windowsProfile{AdminUsername: "azureuser"}
+				}
+				if m.Properties.WindowsProfile.AdminPassword == "" {
+					var err error
+					m.Properties.WindowsProfile.AdminPassword, err = generate()
+					if err != nil {
+						return errors.Wrap(err, "error generating random password for Windows admin user")
+					}
+				}
+			}
+		}
+	}
 	return nil
 }
+
+func writeAPIModel(dir string, m *apiModel) (string, error) {
+	modelJSON, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return "", errors.Wrap(err, "error marshalling api model")
+	}
+	modelPath := filepath.Join(dir, "apimodel.json")
+	// This file may contain a password in it, so make sure it's not readable by anyone but the user.
+	if err := ioutil.WriteFile(modelPath, modelJSON, 0600); err != nil {
+		return "", errors.Wrap(err, "error writing API model to disk")
+	}
+	return modelPath, nil
+}
@@ -0,0 +1,164 @@
+package commands
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCreate(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.cleanup()
+
+	s := e.create("test")
+	if s.Status != stateReady {
+		t.Fatalf("expected status %q, got %q", stateReady, s.Status)
+	}
+	if s.DeploymentName == "" {
+		t.Fatal("expected deployment name to be recorded")
+	}
+	if !e.groupExists(s.ResourceGroup) {
+		t.Fatalf("expected resource group %s to exist", s.ResourceGroup)
+	}
+	if _, err := os.Stat(s.SSHIdentityFile); err != nil {
+		t.Fatalf("expected ssh key to be generated: %v", err)
+	}
+}
+
+func TestCreateExists(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.cleanup()
+
+	e.create("test")
+	err := runCreate(context.Background(), "test", e.createOpts(), nil, ioutil.Discard, ioutil.Discard)
+	if err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Fatalf("expected already exists error, got: %v", err)
+	}
+	if s := e.state("test"); s.Status != stateReady {
+		t.Fatalf("existing cluster should be left alone, got status %q", s.Status)
+	}
+}
+
+func TestCreateDeployFailure(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.cleanup()
+	e.fail("deploy")
+
+	err := runCreate(context.Background(), "test", e.createOpts(), nil, ioutil.Discard, ioutil.Discard)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	s := e.state("test")
+	if s.Status != stateFailure {
+		t.Fatalf("expected status %q, got %q", stateFailure, s.Status)
+	}
+	if len(s.FailureDetails) == 0 {
+		t.Fatal("expected the failed deployment operations to be recorded")
+	}
+	if code := s.failureReason(); code != "FakeFailure" {
+		t.Fatalf("expected failure code FakeFailure, got %q", code)
+	}
+}
+
+func TestCreateGroupFailure(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.cleanup()
+	e.fail("create-group")
+
+	err := runCreate(context.Background(), "test", e.createOpts(), nil, ioutil.Discard, ioutil.Discard)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	s := e.state("test")
+	if s.Status != stateFailure {
+		t.Fatalf("expected status %q, got %q", stateFailure, s.Status)
+	}
+	if !strings.Contains(s.FailureMessage, "resource group") {
+		t.Fatalf("expected failure message about the resource group, got %q", s.FailureMessage)
+	}
+	if s.DeploymentName != "" {
+		t.Fatalf("nothing should have been deployed, got deployment %q", s.DeploymentName)
+	}
+}
+
+func TestCreateResume(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.cleanup()
+	e.fail("deploy")
+
+	if err := runCreate(context.Background(), "test", e.createOpts(), nil, ioutil.Discard, ioutil.Discard); err == nil {
+		t.Fatal("expected error")
+	}
+
+	e.fail("")
+	opts := e.createOpts()
+	opts.Resume = true
+	noSubscription := func() (string, error) { return "", nil }
+	if err := runResume(context.Background(), "test", opts, noSubscription, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	s := e.state("test")
+	if s.Status != stateReady {
+		t.Fatalf("expected status %q, got %q", stateReady, s.Status)
+	}
+	if s.FailureMessage != "" || len(s.FailureDetails) > 0 {
+		t.Fatalf("expected the earlier failure to be cleared, got %q", s.FailureMessage)
+	}
+}
+
+func TestCreateGenerateFailure(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.cleanup()
+
+	opts := e.createOpts()
+	opts.Engines.ACSEngine = filepath.Join(e.dir, "does-not-exist")
+	err := runCreate(context.Background(), "test", opts, nil, ioutil.Discard, ioutil.Discard)
+	if err == nil || !strings.Contains(err.Error(), "could not find acs-engine") {
+		t.Fatalf("expected error about missing acs-engine, got: %v", err)
+	}
+	if s := e.state("test"); s.Status != stateFailure {
+		t.Fatalf("expected status %q, got %q", stateFailure, s.Status)
+	}
+}
+
+func TestCreateNotReady(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.cleanup()
+	e.fail("kubernetes")
+
+	opts := e.createOpts()
+	opts.ReadyTimeout = 100 * time.Millisecond
+	if err := runCreate(context.Background(), "test", opts, nil, ioutil.Discard, ioutil.Discard); err == nil {
+		t.Fatal("expected error")
+	}
+
+	// The deployment succeeded, so the cluster is usable and is not deployed again when resumed.
+	s := e.state("test")
+	if s.Status != stateProvisioned {
+		t.Fatalf("expected status %q, got %q", stateProvisioned, s.Status)
+	}
+	if !strings.Contains(s.FailureMessage, "not ready") {
+		t.Fatalf("expected failure message about Kubernetes not being ready, got %q", s.FailureMessage)
+	}
+
+	e.fail("deploy")
+	opts.Resume = true
+	opts.ReadyTimeout = time.Minute
+	noSubscription := func() (string, error) { return "", nil }
+	if err := runResume(context.Background(), "test", opts, noSubscription, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	s = e.state("test")
+	if s.Status != stateReady {
+		t.Fatalf("expected status %q, got %q", stateReady, s.Status)
+	}
+	if s.FailureMessage != "" {
+		t.Fatalf("expected failure message to be cleared, got %q", s.FailureMessage)
+	}
+}
@@ -2,7 +2,10 @@ package commands
 
 import (
 	"io/ioutil"
+	"regexp"
+	"strings"
 
+	"github.com/Azure/go-autorest/autorest/azure"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 )
@@ -13,6 +16,12 @@ type properties struct {
 	AgentPoolProfiles   []agentPoolProfile   `json:"agentPoolProfiles"`
 	LinuxProfile        *linuxProfile        `json:"linuxProfile"`
 	WindowsProfile      *windowsProfile      `json:"windowsProfile"`
+	CustomCloudProfile  *customCloudProfile  `json:"customCloudProfile,omitempty"`
+}
+
+// customCloudProfile describes the cloud environment to acs-engine for clouds it does not know by location.
+type customCloudProfile struct {
+	Environment *azure.Environment `json:"environment"`
 }
 
 type orchestratorProfile struct {
@@ -21,6 +30,14 @@ type orchestratorProfile struct {
 	KubernetesConfig    *kubernetesConfig `json:"kubernetesConfig"`
 }
 
+// kubernetesRelease gets the release stored as the OrchestratorRelease from a full version, e.g. 1.11.3 -> 1.11.
+func kubernetesRelease(version string) string {
+	if parts := strings.SplitN(version, ".", 3); len(parts) > 2 {
+		return parts[0] + "." + parts[1]
+	}
+	return version
+}
+
 type kubernetesConfig struct {
 	UseManagedIdentity bool   `json:"useManagedIdentity"`
 	NetworkPlugin      string `json:"networkPlugin"`
@@ -67,7 +84,11 @@ type sshKey struct {
 
 type apiModel struct {
 	APIVersion string      `json:"apiVersion"`
+	Location   string      `json:"location,omitempty"`
 	Properties *properties `json:"properties"`
+
+	// raw is the full document the model was decoded from, see model.go
+	raw map[string]interface{}
 }
 
 // Defaults creates the `generate-defaults` subcommand.
@@ -81,7 +102,18 @@ func Defaults() *cobra.Command {
 	}
 }
 
+const (
+	defaultLinuxPool   = "linuxpool1"
+	defaultWindowsPool = "windowspool1"
+)
+
+var agentPoolNameRe = regexp.MustCompile("^[a-z][a-z0-9]{0,11}$")
+
 func defaultModel() *apiModel {
+	// Windows nodes are not deployed unless asked for.
+	windowsPool := newAgentPool(defaultWindowsPool, "Windows")
+	windowsPool.Count = 0
+
 	return &apiModel{
 		APIVersion: "vlabs",
 		Properties: &properties{
@@ -101,25 +133,8 @@ func defaultModel() *apiModel {
 				OSDiskSizeGB:   200,
 			},
 			AgentPoolProfiles: []agentPoolProfile{
-				agentPoolProfile{
-					Name:                         "linuxpool1",
-					Count:                        3,
-					VMSize:                       "Standard_DS2_v2",
-					StorageProfile:               "ManagedDisks",
-					OSDiskSizeGB:                 200,
-					AvailabilityProfile:          "VirtualMachineScaleSets",
-					AcceleratedNetworkingEnabled: boolPtr(true),
-					OSType:                       "Linux",
-				},
-				agentPoolProfile{
-					Name:                "windowspool1",
-					Count:               0,
-					VMSize:              "Standard_DS2_v3",
-					StorageProfile:      "ManagedDisks",
-					OSDiskSizeGB:        200,
-					AvailabilityProfile: "VirtualMachineScaleSets",
-					OSType:              "Windows",
-				},
+				newAgentPool(defaultLinuxPool, "Linux"),
+				windowsPool,
 			},
 			LinuxProfile: &linuxProfile{
 				AdminUsername: "azureuser",
@@ -131,56 +146,149 @@ func defaultModel() *apiModel {
 	}
 }
 
-func overrideModelDefaults(m *apiModel, cfg *UserConfig) error {
+// newAgentPool creates an agent pool with the default settings for the given OS.
+func newAgentPool(name, osType string) agentPoolProfile {
+	p := agentPoolProfile{
+		Name:                name,
+		Count:               3,
+		VMSize:              "Standard_DS2_v2",
+		StorageProfile:      "ManagedDisks",
+		OSDiskSizeGB:        200,
+		AvailabilityProfile: "VirtualMachineScaleSets",
+		OSType:              "Linux",
+	}
+	if strings.EqualFold(osType, "windows") {
+		p.VMSize = "Standard_DS2_v3"
+		p.OSType = "Windows"
+	} else {
+		p.AcceleratedNetworkingEnabled = boolPtr(true)
+	}
+	return p
+}
+
+// agentPool gets the agent pool with the given name, or nil if there is no such pool.
+func (p *properties) agentPool(name string) *agentPoolProfile {
+	for i := range p.AgentPoolProfiles {
+		if p.AgentPoolProfiles[i].Name == name {
+			return &p.AgentPoolProfiles[i]
+		}
+	}
+	return nil
+}
+
+// setAgentPool updates the named agent pool in the model with the values set in the config.
+// If the pool does not exist yet it is added with the defaults for its OS.
+func setAgentPool(m *apiModel, cfg AgentPoolConfig) error {
+	if !agentPoolNameRe.MatchString(cfg.Name) {
+		return errors.Errorf("invalid agent pool name %q: must start with a lowercase letter and contain only lowercase letters and numbers, up to 12 characters", cfg.Name)
+	}
+
+	pool := m.Properties.agentPool(cfg.Name)
+	if pool == nil {
+		osType := cfg.OS
+		if osType == "" {
+			osType = "Linux"
+		}
+		m.Properties.AgentPoolProfiles = append(m.Properties.AgentPoolProfiles, newAgentPool(cfg.Name, osType))
+		pool = &m.Properties.AgentPoolProfiles[len(m.Properties.AgentPoolProfiles)-1]
+	}
+
+	switch strings.ToLower(cfg.OS) {
+	case "":
+	case "linux":
+		pool.OSType = "Linux"
+	case "windows":
+		pool.OSType = "Windows"
+	default:
+		return errors.Errorf("invalid OS %q for agent pool %q: must be linux or windows", cfg.OS, cfg.Name)
+	}
+	if cfg.Count != nil {
+		pool.Count = *cfg.Count
+	}
+	if cfg.SKU != "" {
+		pool.VMSize = cfg.SKU
+	}
+	if cfg.AvailabilityProfile != "" {
+		pool.AvailabilityProfile = cfg.AvailabilityProfile
+	}
+	return nil
+}
+
+// overrideModelDefaults applies the user config to the model.
+// The base profile from the config is always applied, followed by the named profile, if any.
+func overrideModelDefaults(m *apiModel, cfg *UserConfig, profileName string) error {
 	if cfg == nil {
 		return nil
 	}
 
-	if cfg.Profile.Leader.Linux.Count != nil {
-		m.Properties.MasterProfile.Count = *cfg.Profile.Leader.Linux.Count
+	if err := applyProfile(m, &cfg.Profile); err != nil {
+		return err
 	}
-	if cfg.Profile.Leader.Linux.SKU != "" {
-		m.Properties.MasterProfile.VMSize = cfg.Profile.Leader.Linux.SKU
+
+	if profileName == "" {
+		return nil
+	}
+	profile, ok := cfg.Profiles[profileName]
+	if !ok {
+		return errors.Errorf("no such profile in user config: %q", profileName)
+	}
+	return errors.Wrapf(applyProfile(m, &profile), "error in profile %q", profileName)
+}
+
+func applyProfile(m *apiModel, profile *Profile) error {
+	if profile.Leader.Linux.Count != nil {
+		m.Properties.MasterProfile.Count = *profile.Leader.Linux.Count
+	}
+	if profile.Leader.Linux.SKU != "" {
+		m.Properties.MasterProfile.VMSize = profile.Leader.Linux.SKU
 	}
 
-	if cfg.Profile.Agent.Linux.Count != nil {
-		m.Properties.AgentPoolProfiles[0].Count = *cfg.Profile.Agent.Linux.Count
+	linuxPool := m.Properties.agentPool(defaultLinuxPool)
+	if profile.Agent.Linux.Count != nil {
+		linuxPool.Count = *profile.Agent.Linux.Count
 	}
-	if cfg.Profile.Agent.Linux.SKU != "" {
-		m.Properties.AgentPoolProfiles[0].VMSize = cfg.Profile.Agent.Linux.SKU
+	if profile.Agent.Linux.SKU != "" {
+		linuxPool.VMSize = profile.Agent.Linux.SKU
 	}
 
-	if cfg.Profile.Agent.Windows.Count != nil {
-		m.Properties.AgentPoolProfiles[1].Count = *cfg.Profile.Agent.Windows.Count
+	windowsPool := m.Properties.agentPool(defaultWindowsPool)
+	if profile.Agent.Windows.Count != nil {
+		windowsPool.Count = *profile.Agent.Windows.Count
+	}
+	if profile.Agent.Windows.SKU != "" {
+		windowsPool.VMSize = profile.Agent.Windows.SKU
 	}
-	if cfg.Profile.Agent.Windows.SKU != "" {
-		m.Properties.AgentPoolProfiles[1].VMSize = cfg.Profile.Agent.Windows.SKU
+
+	for _, p := range profile.Agent.Pools {
+		if err := setAgentPool(m, p); err != nil {
+			return errors.Wrap(err, "error in user config")
+		}
 	}
 
-	if cfg.Profile.Auth.Linux.User != "" {
-		m.Properties.LinuxProfile.AdminUsername = cfg.Profile.Auth.Linux.User
+	if profile.Auth.Linux.User != "" {
+		m.Properties.LinuxProfile.AdminUsername = profile.Auth.Linux.User
 	}
-	if cfg.Profile.Auth.Linux.PublicKeyFile != "" {
-		keyData, err := ioutil.ReadFile(cfg.Profile.Auth.Linux.PublicKeyFile)
+	if profile.Auth.Linux.PublicKeyFile != "" {
+		keyData, err := ioutil.ReadFile(profile.Auth.Linux.PublicKeyFile)
 		if err != nil {
 			return errors.Wrap(err, "error reading user supplied linux public ssh key file")
 		}
-		m.Properties.LinuxProfile.SSH.PublicKeys = append(m.Properties.LinuxProfile.SSH.PublicKeys, sshKey{KeyData: string(keyData)})
+		m.Properties.LinuxProfile.SSH.PublicKeys = []sshKey{{KeyData: string(keyData)}}
 	}
 
-	if cfg.Profile.Auth.Windows.User != "" {
-		m.Properties.WindowsProfile.AdminUsername = cfg.Profile.Auth.Windows.User
+	if profile.Auth.Windows.User != "" {
+		m.Properties.WindowsProfile.AdminUsername = profile.Auth.Windows.User
 	}
-	if cfg.Profile.Auth.Windows.PasswordFile != "" {
-		pData, err := ioutil.ReadFile(cfg.Profile.Auth.Windows.PasswordFile)
+	if profile.Auth.Windows.PasswordFile != "" {
+		pData, err := ioutil.ReadFile(profile.Auth.Windows.PasswordFile)
 		if err != nil {
 			return errors.Wrap(err, "error reading user supplied windows admin password file")
 		}
 		m.Properties.WindowsProfile.AdminPassword = string(pData)
 	}
 
-	if cfg.Profile.KubernetesVersion != "" {
-		m.Properties.OrchestratorProfile.OrchestratorRelease = cfg.Profile.KubernetesVersion
+	if profile.KubernetesVersion != "" {
+		m.Properties.OrchestratorProfile.OrchestratorRelease = profile.KubernetesVersion
 	}
 
 	return nil
@@ -0,0 +1,182 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+
+	"github.com/Azure/azure-sdk-for-go/profiles/latest/resources/mgmt/resources"
+	"github.com/pkg/errors"
+)
+
+// engineProvisioner provisions clusters with acs-engine, or aks-engine which has the same CLI.
+// The engine generates an ARM template from the API model which is then deployed to the resource group.
+type engineProvisioner struct {
+	name string
+	path string
+}
+
+// run runs the engine with the given args, returning its combined output so it can be reported on failure.
+func (p *engineProvisioner) run(ctx context.Context, args ...string) (string, error) {
+	path, err := exec.LookPath(p.path)
+	if err != nil {
+		return "", errors.Errorf("could not find %s binary", p.name)
+	}
+
+	cmd := exec.CommandContext(ctx, path, args...)
+	buf := bytes.NewBuffer(nil)
+	cmd.Stdout = buf
+	cmd.Stderr = buf
+
+	err = cmd.Run()
+	return buf.String(), err
+}
+
+func (p *engineProvisioner) generate(ctx context.Context, c *cluster) (string, error) {
+	templatePath := filepath.Join(c.dir, "_output", "azuredeploy.json")
+	if _, err := os.Stat(templatePath); err == nil {
+		return templatePath, nil
+	}
+
+	out, err := p.run(ctx, "generate",
+		"--output-directory", filepath.Join(c.dir, "_output"),
+		"--api-model", filepath.Join(c.dir, "apimodel.json"),
+	)
+	if err != nil {
+		c.state.FailureMessage = out
+		return "", errors.Wrapf(err, "%s exited with error: %s", p.name, out)
+	}
+	return templatePath, nil
+}
+
+func (p *engineProvisioner) deploy(ctx context.Context, c *cluster, detach bool) error {
+	client, err := newBackend().deployments(*c.state)
+	if err != nil {
+		return err
+	}
+
+	template, params, err := readACSDeployment(c.dir)
+	if err != nil {
+		return err
+	}
+
+	s := c.state
+	dnsName := c.model.Properties.MasterProfile.DNSPrefix
+	future, err := client.CreateOrUpdate(ctx, s.ResourceGroup, dnsName, resources.Deployment{
+		Properties: &resources.DeploymentProperties{Template: &template, Parameters: &params, Mode: resources.Incremental},
+	})
+	if err != nil {
+		return errors.Wrap(err, "error creating deployment")
+	}
+
+	s.DeploymentName = dnsName
+	s.DNSPrefix = dnsName
+	if err := c.writeState(); err != nil {
+		return err
+	}
+	if detach {
+		return nil
+	}
+
+	progress := newDeploymentProgress(client, s.ResourceGroup, dnsName, c.errW)
+	progressCtx, cancelProgress := context.WithCancel(ctx)
+	progressDone := make(chan struct{})
+	go func() {
+		progress.watch(progressCtx, progressInterval)
+		close(progressDone)
+	}()
+
+	deployment, err := future.Wait(ctx)
+	cancelProgress()
+	<-progressDone
+	progress.poll(ctx)
+	if err != nil {
+		recordDeploymentFailures(ctx, client, s, c.errW)
+		return errors.Wrap(err, "error in deployment")
+	}
+
+	s.DeploymentName = *deployment.Name
+	return nil
+}
+
+// authArgs gets the args for the engine to authenticate the same way testrig does.
+func (p *engineProvisioner) authArgs(c *cluster) ([]string, error) {
+	env, err := c.state.environment()
+	if err != nil {
+		return nil, err
+	}
+	args := []string{"--azure-env", env.Name}
+	if clientID, secret, ok := servicePrincipal(); ok {
+		return append(args, "--auth-method", "client_secret", "--client-id", clientID, "--client-secret", secret), nil
+	}
+	return append(args, "--auth-method", "cli"), nil
+}
+
+func (p *engineProvisioner) scale(ctx context.Context, c *cluster, pool string, count int) error {
+	agentPool := c.model.Properties.agentPool(pool)
+	if agentPool == nil {
+		return errors.Errorf("no agent pool named %q", pool)
+	}
+
+	authArgs, err := p.authArgs(c)
+	if err != nil {
+		return err
+	}
+	args := append([]string{"scale",
+		"--subscription-id", c.state.SubscriptionID,
+		"--resource-group", c.state.ResourceGroup,
+		"--location", c.state.Location,
+		"--deployment-dir", filepath.Join(c.dir, "_output"),
+		"--master-FQDN", makeFQDN(*c.state),
+		"--node-pool", pool,
+		"--new-node-count", strconv.Itoa(count),
+	}, authArgs...)
+	if out, err := p.run(ctx, args...); err != nil {
+		return errors.Wrapf(err, "%s exited with error: %s", p.name, out)
+	}
+
+	agentPool.Count = count
+	_, err = writeAPIModel(c.dir, c.model)
+	return err
+}
+
+func (p *engineProvisioner) upgrade(ctx context.Context, c *cluster, version string) error {
+	authArgs, err := p.authArgs(c)
+	if err != nil {
+		return err
+	}
+	args := append([]string{"upgrade",
+		"--subscription-id", c.state.SubscriptionID,
+		"--resource-group", c.state.ResourceGroup,
+		"--location", c.state.Location,
+		"--deployment-dir", filepath.Join(c.dir, "_output"),
+		"--upgrade-version", version,
+	}, authArgs...)
+	if out, err := p.run(ctx, args...); err != nil {
+		return errors.Wrapf(err, "%s exited with error: %s", p.name, out)
+	}
+
+	// The model only has the release, the engine keeps track of the exact version in its own copy of the model.
+	c.model.Properties.OrchestratorProfile.OrchestratorRelease = kubernetesRelease(version)
+	_, err = writeAPIModel(c.dir, c.model)
+	return err
+}
+
+func (p *engineProvisioner) delete(ctx context.Context, c *cluster) (groupDeleteFuture, error) {
+	return deleteResourceGroup(ctx, c)
+}
+
+func (p *engineProvisioner) kubeConfig(ctx context.Context, c *cluster) (string, error) {
+	path := filepath.Join(c.dir, "_output", "kubeconfig", "kubeconfig."+c.state.Location+".json")
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) && c.state.FailureMessage != "" {
+			// Adopted clusters record why the kubeconfig could not be fetched.
+			return "", errors.Errorf("kubeconfig not found at %s, %s", path, c.state.FailureMessage)
+		}
+		return "", errors.Wrap(err, "kubeconfig not found")
+	}
+	return path, nil
+}
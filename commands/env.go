@@ -0,0 +1,173 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/cpuguy83/strongerrors"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// envVars are the names of the variables set by `env`, in the order they are written out.
+var envVars = []string{
+	"KUBECONFIG",
+	"TESTRIG_CLUSTER",
+	"TESTRIG_SSH_IDENTITY_FILE",
+	"TESTRIG_LEADER_FQDN",
+	"TESTRIG_ADMIN_USER",
+	"TESTRIG_RESOURCE_GROUP",
+}
+
+// shellSyntax is how variables are set and unset in a shell.
+type shellSyntax struct {
+	set   func(name, value string) string
+	unset func(name string) string
+	// eval is the command to evaluate the output of `env` in the shell, %s is replaced with the args to `env`.
+	eval string
+}
+
+var shells = map[string]shellSyntax{
+	"bash": {
+		set:   func(name, value string) string { return "export " + name + "=" + quoteShell(value) },
+		unset: func(name string) string { return "unset " + name },
+		eval:  "eval $(testrig env %s)",
+	},
+	"fish": {
+		set:   func(name, value string) string { return "set -gx " + name + " " + quoteFish(value) + ";" },
+		unset: func(name string) string { return "set -e " + name + ";" },
+		eval:  "eval (testrig env %s)",
+	},
+	"powershell": {
+		set:   func(name, value string) string { return "$Env:" + name + " = " + quotePowerShell(value) },
+		unset: func(name string) string { return "Remove-Item Env:\\" + name + " -ErrorAction SilentlyContinue" },
+		eval:  "& testrig env %s | Invoke-Expression",
+	},
+}
+
+// Env creates the `env` subcommand which prints the commands to set up a shell for a cluster.
+func Env(ctx context.Context, stateDir string) *cobra.Command {
+	var (
+		shell string
+		unset bool
+	)
+
+	cmd := &cobra.Command{
+		Use:     "env",
+		Example: "eval $(testrig env <name>)",
+		Short:   "Print the commands to set environment variables for using a cluster from a shell",
+		Args:    cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if shell == "" {
+				shell = detectShell()
+			}
+			syntax, ok := shells[shell]
+			if !ok {
+				return errors.Errorf("unsupported shell %q, must be one of: bash, fish, powershell", shell)
+			}
+
+			if unset {
+				return runEnvUnset(syntax, shell, cmd.OutOrStdout())
+			}
+			if len(args) != 1 {
+				return errors.New("must specify a cluster name")
+			}
+			return runEnv(ctx, args[0], stateDir, syntax, shell, cmd.OutOrStdout())
+		},
+	}
+
+	flags := cmd.Flags()
+	flags.StringVar(&shell, "shell", "", "Shell to print the commands for, one of: bash, fish, powershell (defaults to the current shell)")
+	flags.BoolVarP(&unset, "unset", "u", false, "Print the commands to unset the variables instead")
+	return cmd
+}
+
+func runEnv(ctx context.Context, name, stateDir string, syntax shellSyntax, shell string, outW io.Writer) error {
+	values, err := clusterEnv(ctx, name, stateDir)
+	if err != nil {
+		return err
+	}
+	for _, v := range envVars {
+		io.WriteString(outW, syntax.set(v, values[v])+"\n")
+	}
+	writeEvalHint(outW, syntax, shell, name)
+	return nil
+}
+
+// clusterEnv gets the values of the envVars for a cluster.
+func clusterEnv(ctx context.Context, name, stateDir string) (map[string]string, error) {
+	dir := filepath.Join(stateDir, name)
+	s, kubeConfig, err := clusterKubeConfig(ctx, name, stateDir)
+	if err != nil {
+		if strongerrors.IsNotFound(err) {
+			return nil, clusterNotFound(name)
+		}
+		return nil, err
+	}
+	model, err := readAPIModel(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	identityFile := s.SSHIdentityFile
+	if identityFile == "" {
+		maybe := filepath.Join(dir, "_output", "azureuser_rsa")
+		if _, err := os.Stat(maybe); err == nil {
+			identityFile = maybe
+		}
+	}
+
+	return map[string]string{
+		"KUBECONFIG":                kubeConfig,
+		"TESTRIG_CLUSTER":           name,
+		"TESTRIG_SSH_IDENTITY_FILE": identityFile,
+		"TESTRIG_LEADER_FQDN":       makeFQDN(s),
+		"TESTRIG_ADMIN_USER":        model.Properties.LinuxProfile.AdminUsername,
+		"TESTRIG_RESOURCE_GROUP":    s.ResourceGroup,
+	}, nil
+}
+
+func runEnvUnset(syntax shellSyntax, shell string, outW io.Writer) error {
+	for _, v := range envVars {
+		io.WriteString(outW, syntax.unset(v)+"\n")
+	}
+	writeEvalHint(outW, syntax, shell, "--unset")
+	return nil
+}
+
+func writeEvalHint(outW io.Writer, syntax shellSyntax, shell, args string) {
+	if shell != detectShell() {
+		args = "--shell " + shell + " " + args
+	}
+	io.WriteString(outW, "# Run this command to configure your shell:\n")
+	fmt.Fprintf(outW, "# "+syntax.eval+"\n", args)
+}
+
+// detectShell guesses the shell `env` is being run from.
+func detectShell() string {
+	if strings.HasSuffix(filepath.Base(os.Getenv("SHELL")), "fish") {
+		return "fish"
+	}
+	if runtime.GOOS == "windows" && os.Getenv("SHELL") == "" {
+		return "powershell"
+	}
+	return "bash"
+}
+
+// quoteShell quotes a value for a POSIX shell.
+func quoteShell(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func quoteFish(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+}
+
+func quotePowerShell(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
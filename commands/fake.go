@@ -0,0 +1,510 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/profiles/latest/resources/mgmt/resources"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/date"
+	"github.com/pkg/errors"
+)
+
+// Environment variables which control the behavior of the fake backend.
+const (
+	// fakeDeployTimeEnv is how long deployments take, as a duration (default 10s).
+	fakeDeployTimeEnv = "TESTRIG_FAKE_AZURE_DEPLOY_TIME"
+	// fakeFailEnv is a comma separated list of operations which fail: create-group, delete-group and deploy.
+	// delete-group-async has deletions of resource groups fail after they have been started, and kubernetes has the
+	// Kubernetes API server of clusters never come up, see checkKubernetes.
+	// throttle can be added to have the first request to delete each resource group throttled.
+	fakeFailEnv = "TESTRIG_FAKE_AZURE_FAIL"
+)
+
+// fakeBackend simulates the resource group and deployment APIs so the CLI can be exercised without an Azure subscription.
+// State is kept on disk (one file per resource group) so it is shared between invocations of testrig.
+// Deployments take some time to complete, with each resource in the template getting its own operation, and
+// resource groups removed from the dir (or never created) result in 404s just like in Azure.
+type fakeBackend struct {
+	dir string
+}
+
+// fakeGroup is the on disk representation of a resource group in the fake backend.
+type fakeGroup struct {
+	Group       resources.Group
+	Deployments map[string]*fakeDeployment
+	// DeleteAfter is set once the group is being deleted, it is gone after this time.
+	DeleteAfter *time.Time `json:",omitempty"`
+}
+
+type fakeDeployment struct {
+	Name       string
+	Started    time.Time
+	Duration   time.Duration
+	Fail       bool
+	Resources  []fakeResource
+	Parameters interface{}
+}
+
+type fakeResource struct {
+	Type string
+	Name string
+}
+
+// fakeLock serializes access to the files of the fake backend within the process.
+var fakeLock sync.Mutex
+
+// fakeThrottled are the resource groups which have had a delete request throttled, see fakeFailEnv.
+var fakeThrottled = make(map[string]bool)
+
+func (b *fakeBackend) groups(s state) (groupsClient, error) {
+	if s.SubscriptionID == "" {
+		return nil, errors.New("no subscription set")
+	}
+	return fakeGroups{&fakeSubscription{dir: filepath.Join(b.dir, s.SubscriptionID)}}, nil
+}
+
+func (b *fakeBackend) deployments(s state) (deploymentsClient, error) {
+	if s.SubscriptionID == "" {
+		return nil, errors.New("no subscription set")
+	}
+	return fakeDeployments{&fakeSubscription{dir: filepath.Join(b.dir, s.SubscriptionID)}}, nil
+}
+
+// fakeSubscription holds the resource groups of a subscription.
+type fakeSubscription struct {
+	dir string
+}
+
+type fakeGroups struct {
+	*fakeSubscription
+}
+
+type fakeDeployments struct {
+	*fakeSubscription
+}
+
+func fakeFails(op string) bool {
+	for _, f := range strings.Split(os.Getenv(fakeFailEnv), ",") {
+		if strings.TrimSpace(f) == op {
+			return true
+		}
+	}
+	return false
+}
+
+func fakeError(code int, msg string) error {
+	return autorest.DetailedError{StatusCode: code, Message: msg}
+}
+
+func (f *fakeSubscription) path(group string) string {
+	return filepath.Join(f.dir, strings.ToLower(group)+".json")
+}
+
+func (f *fakeSubscription) read(group string) (*fakeGroup, error) {
+	data, err := ioutil.ReadFile(f.path(group))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fakeError(http.StatusNotFound, "resource group "+group+" could not be found")
+		}
+		return nil, err
+	}
+	var g fakeGroup
+	if err := json.Unmarshal(data, &g); err != nil {
+		return nil, errors.Wrapf(err, "error decoding fake resource group %q", group)
+	}
+	if g.DeleteAfter != nil && time.Now().After(*g.DeleteAfter) {
+		if err := os.Remove(f.path(group)); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return nil, fakeError(http.StatusNotFound, "resource group "+group+" could not be found")
+	}
+	return &g, nil
+}
+
+func (f *fakeSubscription) write(g *fakeGroup) error {
+	if err := os.MkdirAll(f.dir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(g, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(f.path(*g.Group.Name), data, 0644)
+}
+
+func (f fakeGroups) Get(ctx context.Context, name string) (resources.Group, error) {
+	fakeLock.Lock()
+	defer fakeLock.Unlock()
+
+	g, err := f.read(name)
+	if err != nil {
+		return resources.Group{}, err
+	}
+	return g.Group, nil
+}
+
+func (f fakeGroups) CreateOrUpdate(ctx context.Context, name string, group resources.Group) (resources.Group, error) {
+	if fakeFails("create-group") {
+		return resources.Group{}, fakeError(http.StatusInternalServerError, "fake failure creating resource group")
+	}
+
+	fakeLock.Lock()
+	defer fakeLock.Unlock()
+
+	g, err := f.read(name)
+	if err != nil {
+		if !isAzureNotFound(err) {
+			return resources.Group{}, err
+		}
+		g = &fakeGroup{Deployments: make(map[string]*fakeDeployment)}
+	}
+	group.Name = &name
+	group.ID = stringPtr("/subscriptions/" + filepath.Base(f.dir) + "/resourceGroups/" + name)
+	group.Properties = &resources.GroupProperties{ProvisioningState: stringPtr("Succeeded")}
+	g.Group = group
+	return group, f.write(g)
+}
+
+func (f fakeGroups) Delete(ctx context.Context, name string) (groupDeleteFuture, error) {
+	if fakeFails("delete-group") {
+		return nil, fakeError(http.StatusInternalServerError, "fake failure deleting resource group")
+	}
+
+	fakeLock.Lock()
+	defer fakeLock.Unlock()
+
+	if fakeFails("throttle") && !fakeThrottled[name] {
+		fakeThrottled[name] = true
+		return nil, autorest.DetailedError{
+			StatusCode: http.StatusTooManyRequests,
+			Message:    "fake throttling of resource group deletion",
+			Response:   &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": []string{"1"}}},
+		}
+	}
+
+	g, err := f.read(name)
+	if err != nil {
+		return nil, err
+	}
+	// Deleting a resource group takes a while
+	if g.DeleteAfter == nil {
+		deleteAfter := time.Now().Add(fakeDeployTime() / 2)
+		g.DeleteAfter = &deleteAfter
+		if err := f.write(g); err != nil {
+			return nil, err
+		}
+	}
+	return fakeGroupDeleteFuture{fakeSubscription: f.fakeSubscription, Group: name}, nil
+}
+
+func (f fakeGroups) ResumeDelete(saved json.RawMessage) (groupDeleteFuture, error) {
+	future := fakeGroupDeleteFuture{fakeSubscription: f.fakeSubscription}
+	if err := json.Unmarshal(saved, &future); err != nil {
+		return nil, errors.Wrap(err, "error decoding saved resource group deletion")
+	}
+	return future, nil
+}
+
+type fakeGroupDeleteFuture struct {
+	*fakeSubscription `json:"-"`
+	Group             string
+}
+
+func (f fakeGroupDeleteFuture) Wait(ctx context.Context) error {
+	for {
+		done, wait, err := f.check()
+		if done || err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (f fakeGroupDeleteFuture) Done(ctx context.Context) (bool, error) {
+	done, _, err := f.check()
+	return done, err
+}
+
+// check checks if the group is gone, and if it is not how long until it will be.
+func (f fakeGroupDeleteFuture) check() (bool, time.Duration, error) {
+	fakeLock.Lock()
+	g, err := f.read(f.Group)
+	if err == nil && g.DeleteAfter != nil && fakeFails("delete-group-async") {
+		// The group is left behind, like it is when deleting some of its resources fails.
+		g.DeleteAfter = nil
+		err = f.write(g)
+		fakeLock.Unlock()
+		if err != nil {
+			return false, 0, err
+		}
+		return true, 0, fakeError(http.StatusConflict, "fake failure while deleting resource group")
+	}
+	fakeLock.Unlock()
+	if err != nil {
+		if isAzureNotFound(err) {
+			return true, 0, nil
+		}
+		return false, 0, err
+	}
+	if g.DeleteAfter == nil {
+		// Re-created since.
+		return true, 0, nil
+	}
+	return false, time.Until(*g.DeleteAfter), nil
+}
+
+func (f fakeGroupDeleteFuture) MarshalJSON() ([]byte, error) {
+	// Same as the real futures, which include the URL to poll.
+	return json.Marshal(map[string]string{
+		"group":      f.Group,
+		"pollingURI": "fake://" + filepath.ToSlash(f.path(f.Group)),
+	})
+}
+
+func (f fakeGroups) Exists(ctx context.Context, name string) (bool, error) {
+	fakeLock.Lock()
+	defer fakeLock.Unlock()
+
+	// Goes through read so groups whose deletion has finished are gone.
+	if _, err := f.read(name); err != nil {
+		if isAzureNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (f fakeGroups) ListByTag(ctx context.Context, tag string) ([]resources.Group, error) {
+	fakeLock.Lock()
+	defer fakeLock.Unlock()
+
+	ls, err := ioutil.ReadDir(f.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var groups []resources.Group
+	for _, fi := range ls {
+		if !strings.HasSuffix(fi.Name(), ".json") {
+			continue
+		}
+		g, err := f.read(strings.TrimSuffix(fi.Name(), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := g.Group.Tags[tag]; ok {
+			groups = append(groups, g.Group)
+		}
+	}
+	return groups, nil
+}
+
+func fakeDeployTime() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv(fakeDeployTimeEnv)); err == nil {
+		return d
+	}
+	return 10 * time.Second
+}
+
+func (f fakeDeployments) CreateOrUpdate(ctx context.Context, group, name string, deployment resources.Deployment) (deploymentFuture, error) {
+	fakeLock.Lock()
+	defer fakeLock.Unlock()
+
+	g, err := f.read(group)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &fakeDeployment{
+		Name:     name,
+		Started:  time.Now(),
+		Duration: fakeDeployTime(),
+		Fail:     fakeFails("deploy"),
+	}
+	if deployment.Properties != nil {
+		d.Parameters = deref(deployment.Properties.Parameters)
+		d.Resources = templateResources(deref(deployment.Properties.Template))
+	}
+	if len(d.Resources) == 0 {
+		d.Resources = []fakeResource{{Type: "Microsoft.Resources/deployments", Name: name}}
+	}
+
+	if g.Deployments == nil {
+		g.Deployments = make(map[string]*fakeDeployment)
+	}
+	g.Deployments[name] = d
+	if err := f.write(g); err != nil {
+		return nil, err
+	}
+	return &fakeDeploymentFuture{sub: f, group: group, name: name}, nil
+}
+
+// deref gets the value pointed to by v if it is a pointer to an interface, which is how the template and parameters
+// of a deployment are usually passed.
+func deref(v interface{}) interface{} {
+	if p, ok := v.(*interface{}); ok && p != nil {
+		return *p
+	}
+	return v
+}
+
+// templateResources gets the type and name of the top level resources in an ARM template.
+func templateResources(template interface{}) []fakeResource {
+	t, ok := template.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	ls, _ := t["resources"].([]interface{})
+
+	var out []fakeResource
+	for _, r := range ls {
+		r, ok := r.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		typ, _ := r["type"].(string)
+		name, _ := r["name"].(string)
+		out = append(out, fakeResource{Type: typ, Name: name})
+	}
+	return out
+}
+
+// provisioningState gets the state of the deployment as of now.
+func (d *fakeDeployment) provisioningState(now time.Time) string {
+	if now.Sub(d.Started) < d.Duration {
+		return "Running"
+	}
+	if d.Fail {
+		return "Failed"
+	}
+	return "Succeeded"
+}
+
+func (d *fakeDeployment) extended(group string) resources.DeploymentExtended {
+	return resources.DeploymentExtended{
+		Name: stringPtr(d.Name),
+		Properties: &resources.DeploymentPropertiesExtended{
+			ProvisioningState: stringPtr(d.provisioningState(time.Now())),
+			Timestamp:         &date.Time{Time: d.Started},
+			Parameters:        d.Parameters,
+		},
+	}
+}
+
+func (f *fakeSubscription) deployment(group, name string) (*fakeDeployment, error) {
+	fakeLock.Lock()
+	defer fakeLock.Unlock()
+
+	g, err := f.read(group)
+	if err != nil {
+		return nil, err
+	}
+	d, ok := g.Deployments[name]
+	if !ok {
+		return nil, fakeError(http.StatusNotFound, "deployment "+name+" could not be found")
+	}
+	return d, nil
+}
+
+func (f fakeDeployments) Get(ctx context.Context, group, name string) (resources.DeploymentExtended, error) {
+	d, err := f.deployment(group, name)
+	if err != nil {
+		return resources.DeploymentExtended{}, err
+	}
+	return d.extended(group), nil
+}
+
+func (f fakeDeployments) List(ctx context.Context, group string) ([]resources.DeploymentExtended, error) {
+	fakeLock.Lock()
+	defer fakeLock.Unlock()
+
+	g, err := f.read(group)
+	if err != nil {
+		return nil, err
+	}
+	var out []resources.DeploymentExtended
+	for _, d := range g.Deployments {
+		out = append(out, d.extended(group))
+	}
+	return out, nil
+}
+
+// ListOperations reports an operation per resource in the template, which are spread out evenly over the duration of the deployment.
+// When the deployment fails, the last operation is the one which failed.
+func (f fakeDeployments) ListOperations(ctx context.Context, group, name string) ([]resources.DeploymentOperation, error) {
+	d, err := f.deployment(group, name)
+	if err != nil {
+		return nil, err
+	}
+
+	elapsed := time.Since(d.Started)
+	step := d.Duration / time.Duration(len(d.Resources))
+	var ops []resources.DeploymentOperation
+	for i, r := range d.Resources {
+		start := time.Duration(i) * step
+		if elapsed < start {
+			break
+		}
+		props := &resources.DeploymentOperationProperties{
+			ProvisioningState: stringPtr("Running"),
+			TargetResource:    &resources.TargetResource{ResourceType: stringPtr(r.Type), ResourceName: stringPtr(r.Name)},
+		}
+		if elapsed >= start+step {
+			props.ProvisioningState = stringPtr("Succeeded")
+			if d.Fail && i == len(d.Resources)-1 {
+				props.ProvisioningState = stringPtr("Failed")
+				props.StatusCode = stringPtr("Conflict")
+				props.StatusMessage = map[string]interface{}{
+					"error": map[string]interface{}{"code": "FakeFailure", "message": "fake failure deploying " + r.Name},
+				}
+			}
+		}
+		ops = append(ops, resources.DeploymentOperation{OperationID: stringPtr(strconv.Itoa(i)), Properties: props})
+	}
+	return ops, nil
+}
+
+type fakeDeploymentFuture struct {
+	sub   fakeDeployments
+	group string
+	name  string
+}
+
+func (f *fakeDeploymentFuture) Wait(ctx context.Context) (resources.DeploymentExtended, error) {
+	for {
+		d, err := f.sub.Get(ctx, f.group, f.name)
+		if err != nil {
+			return d, err
+		}
+		switch *d.Properties.ProvisioningState {
+		case "Succeeded":
+			return d, nil
+		case "Failed":
+			return d, fakeError(http.StatusConflict, "deployment "+f.name+" failed")
+		}
+
+		select {
+		case <-ctx.Done():
+			return d, ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// GC creates a command to remove all clusters whose TTL has passed.
+func GC(ctx context.Context, stateDir string, cfg *UserConfig) *cobra.Command {
+	var (
+		dryRun         bool
+		subscriptionID string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "gc",
+		Short: "Remove all expired clusters",
+		Long:  "Remove all clusters which were created with a TTL (`create --ttl`) that has passed",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			fallbackSubscription := func() (string, error) {
+				return resolveSubscription(subscriptionID, cfg)
+			}
+			return runGC(ctx, stateDir, fallbackSubscription, dryRun, cmd.OutOrStdout(), cmd.OutOrStderr())
+		},
+	}
+
+	flags := cmd.Flags()
+	flags.BoolVar(&dryRun, "dry-run", false, "List the expired clusters without removing them")
+	flags.StringVarP(&subscriptionID, "subscription", "s", "", "Set the subscription to use for clusters which do not have one recorded in their state")
+	return cmd
+}
+
+var gcHeader = []byte("NAME\tSTATUS\tEXPIRED\n")
+
+func runGC(ctx context.Context, stateDir string, fallbackSubscription func() (string, error), dryRun bool, outW, errW io.Writer) error {
+	if !dryRun {
+		resumeRemovals(ctx, stateDir, errW)
+	}
+
+	expired, err := expiredClusters(stateDir, time.Now())
+	if err != nil {
+		return err
+	}
+
+	if dryRun {
+		buf := bytes.NewBuffer(nil)
+		tw := tabwriter.NewWriter(buf, 20, 1, 3, ' ', tabwriter.TabIndent)
+		if _, err := tw.Write(gcHeader); err != nil {
+			return errors.Wrap(err, "error writing table header")
+		}
+		for _, c := range expired {
+			io.WriteString(tw, c.name+"\t")
+			io.WriteString(tw, strings.Title(string(c.state.Status))+"\t")
+			io.WriteString(tw, time.Since(*c.state.ExpiresAt).Round(time.Minute).String()+" ago")
+			io.WriteString(tw, "\n")
+		}
+		if err := tw.Flush(); err != nil {
+			return errors.Wrap(err, "error flushing table writer")
+		}
+		_, err := io.Copy(outW, buf)
+		return err
+	}
+
+	if len(expired) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(expired))
+	for _, c := range expired {
+		names = append(names, c.name)
+	}
+	return runRemove(ctx, names, stateDir, removeOpts{Parallel: defaultRemoveParallel, FallbackSubscription: fallbackSubscription}, outW, errW)
+}
+
+type clusterState struct {
+	name  string
+	state state
+}
+
+// expiredClusters gets the clusters in the state dir which have expired and can be removed.
+func expiredClusters(stateDir string, now time.Time) ([]clusterState, error) {
+	names, err := listClusters(stateDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var expired []clusterState
+	for _, name := range names {
+		s, err := readState(filepath.Join(stateDir, name))
+		if err != nil {
+			continue
+		}
+		if !s.expired(now) {
+			continue
+		}
+		switch s.Status {
+		case stateInitialized, stateCreating, stateRemoving:
+			// These can't be removed, same as `rm`.
+			continue
+		}
+		expired = append(expired, clusterState{name: name, state: s})
+	}
+
+	sort.Slice(expired, func(i, j int) bool {
+		return expired[i].name < expired[j].name
+	})
+	return expired, nil
+}
@@ -13,6 +13,7 @@ import (
 	"math/rand"
 	"net/http"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -28,6 +29,10 @@ func boolPtr(b bool) *bool {
 	return &b
 }
 
+func stringPtr(s string) *string {
+	return &s
+}
+
 func generateRandom() (string, error) {
 	rand.Seed(time.Now().Unix())
 	buf := make([]byte, 8)
@@ -38,10 +43,17 @@ func generateRandom() (string, error) {
 }
 
 func makeFQDN(cfg state) string {
+	if cfg.FQDN != "" {
+		return cfg.FQDN
+	}
 	if cfg.DNSPrefix == "" || cfg.Location == "" {
 		return ""
 	}
-	return fmt.Sprintf("%s.%s.cloudapp.azure.com", cfg.DNSPrefix, cfg.Location)
+	suffix := azure.PublicCloud.ResourceManagerVMDNSSuffix
+	if env, err := cfg.environment(); err == nil {
+		suffix = env.ResourceManagerVMDNSSuffix
+	}
+	return fmt.Sprintf("%s.%s.%s", cfg.DNSPrefix, cfg.Location, suffix)
 }
 
 func readAPIModel(dir string) (apiModel, error) {
@@ -84,6 +96,69 @@ func (s *sshConfig) Type() string {
 	return "sshKey"
 }
 
+// agentPoolsFlag is a repeatable flag for configuring agent pools.
+// Each value is a comma separated list of key=value pairs, e.g. `name=pool2,os=linux,count=2,sku=Standard_DS2_v2`.
+type agentPoolsFlag []AgentPoolConfig
+
+func (f *agentPoolsFlag) Set(v string) error {
+	var cfg AgentPoolConfig
+	for _, kv := range strings.Split(v, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return errors.Errorf("invalid pool option %q, expected key=value", kv)
+		}
+		key, value := strings.ToLower(strings.TrimSpace(parts[0])), strings.TrimSpace(parts[1])
+		switch key {
+		case "name":
+			cfg.Name = value
+		case "os":
+			cfg.OS = value
+		case "sku":
+			cfg.SKU = value
+		case "count":
+			count, err := strconv.Atoi(value)
+			if err != nil || count < 0 {
+				return errors.Errorf("invalid pool count %q", value)
+			}
+			cfg.Count = &count
+		case "availability":
+			cfg.AvailabilityProfile = value
+		default:
+			return errors.Errorf("unknown pool option %q, must be one of: name, os, count, sku, availability", key)
+		}
+	}
+	if cfg.Name == "" {
+		return errors.New("pool name is required")
+	}
+	*f = append(*f, cfg)
+	return nil
+}
+
+func (f *agentPoolsFlag) String() string {
+	var pools []string
+	for _, cfg := range *f {
+		opts := []string{"name=" + cfg.Name}
+		if cfg.OS != "" {
+			opts = append(opts, "os="+cfg.OS)
+		}
+		if cfg.Count != nil {
+			opts = append(opts, "count="+strconv.Itoa(*cfg.Count))
+		}
+		if cfg.SKU != "" {
+			opts = append(opts, "sku="+cfg.SKU)
+		}
+		if cfg.AvailabilityProfile != "" {
+			opts = append(opts, "availability="+cfg.AvailabilityProfile)
+		}
+		pools = append(pools, strings.Join(opts, ","))
+	}
+	return strings.Join(pools, " ")
+}
+
+func (f *agentPoolsFlag) Type() string {
+	return "pool"
+}
+
 func createSSHKey(keyW io.Writer) (string, error) {
 	privateKey, err := rsa.GenerateKey(crand.Reader, 2048)
 	if err != nil {
@@ -133,6 +208,39 @@ func clusterNotFound(name string) error {
 	return strongerrors.NotFound(errors.Errorf("no such cluster: %q", name))
 }
 
+// azureThrottled checks if the error is from Azure throttling requests, returning how long it asked to wait for if it did.
+func azureThrottled(err error) (time.Duration, bool) {
+	var resp *http.Response
+	switch e := err.(type) {
+	case *azure.RequestError:
+		if e.StatusCode == 0 {
+			return azureThrottled(e.Original)
+		}
+		resp = e.Response
+		if e.StatusCode != http.StatusTooManyRequests {
+			return 0, false
+		}
+	case autorest.DetailedError:
+		if e.StatusCode == 0 {
+			return azureThrottled(e.Original)
+		}
+		resp = e.Response
+		if e.StatusCode != http.StatusTooManyRequests {
+			return 0, false
+		}
+	default:
+		return 0, false
+	}
+
+	var wait time.Duration
+	if resp != nil {
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			wait = time.Duration(secs) * time.Second
+		}
+	}
+	return wait, true
+}
+
 func isAzureNotFound(err error) bool {
 	if err == nil {
 		return false
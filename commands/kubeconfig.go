@@ -3,35 +3,280 @@ package commands
 import (
 	"context"
 	"io"
+	"io/ioutil"
+	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 
+	"github.com/ghodss/yaml"
+	homedir "github.com/mitchellh/go-homedir"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 )
 
 // KubeConfig creates a a command to get the kubeconfig for a cluster
 func KubeConfig(ctx context.Context, stateDir string) *cobra.Command {
+	var merge, use bool
+
 	cmd := &cobra.Command{
 		Use:   "kubeconfig",
 		Short: "Get the path to the kubeconfig file for the specified cluster",
+		Long:  "Get the path to the kubeconfig file for the specified cluster, or with --merge add the cluster's credentials to the user's kubeconfig and print its path",
 		Args:  cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if merge || use {
+				return runKubeConfigMerge(ctx, args[0], stateDir, use, cmd.OutOrStdout())
+			}
 			return runKubeConfig(ctx, args[0], stateDir, cmd.OutOrStdout())
 		},
 	}
+
+	flags := cmd.Flags()
+	flags.BoolVar(&merge, "merge", false, "Merge the cluster's credentials into the user's kubeconfig")
+	flags.BoolVar(&use, "use", false, "Switch the current context of the user's kubeconfig to the cluster, implies --merge")
 	return cmd
 }
 
 func runKubeConfig(ctx context.Context, name string, stateDir string, outW io.Writer) error {
+	_, path, err := clusterKubeConfig(ctx, name, stateDir)
+	if err != nil {
+		return err
+	}
+	io.WriteString(outW, path)
+	return nil
+}
+
+// clusterKubeConfig gets the state of the cluster and the path to its admin kubeconfig.
+func clusterKubeConfig(ctx context.Context, name string, stateDir string) (state, string, error) {
 	dir := filepath.Join(stateDir, name)
 	s, err := readState(dir)
+	if err != nil {
+		return s, "", err
+	}
+	if s.Status != stateReady && s.Status != stateProvisioned {
+		return s, "", errors.Errorf("cluster is not ready, kubeconfig is not available, current state: %s", strings.Title(string(s.Status)))
+	}
+	p, err := newProvisioner(s.Provisioner, enginePaths{})
+	if err != nil {
+		return s, "", err
+	}
+	path, err := p.kubeConfig(ctx, &cluster{name: name, dir: dir, state: &s})
+	return s, path, err
+}
+
+func runKubeConfigMerge(ctx context.Context, name string, stateDir string, use bool, outW io.Writer) error {
+	s, src, err := clusterKubeConfig(ctx, name, stateDir)
 	if err != nil {
 		return err
 	}
-	if s.Status != stateReady {
-		return errors.Errorf("cluster is not read, kubeconfig is not available, current state: %s", strings.Title(string(s.Status)))
+	dst, err := userKubeConfigPath()
+	if err != nil {
+		return err
+	}
+
+	// Record where the entries are going first, so they are cleaned up on removal even if this fails part of the way.
+	s.MergedKubeConfig = dst
+	if err := writeState(filepath.Join(stateDir, name), s); err != nil {
+		return err
+	}
+	if err := mergeKubeConfig(name, src, dst, use); err != nil {
+		return err
 	}
-	io.WriteString(outW, filepath.Join(dir, "_output", "kubeconfig", "kubeconfig."+s.Location+".json"))
+	io.WriteString(outW, dst)
 	return nil
 }
+
+// userKubeConfigPath gets the kubeconfig kubectl uses by default, which is where cluster credentials are merged into.
+// Like kubectl, new entries go into the first file listed in $KUBECONFIG.
+func userKubeConfigPath() (string, error) {
+	if env := os.Getenv("KUBECONFIG"); env != "" {
+		for _, p := range filepath.SplitList(env) {
+			if p != "" {
+				return p, nil
+			}
+		}
+	}
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", errors.Wrap(err, "error getting home dir")
+	}
+	return filepath.Join(home, ".kube", "config"), nil
+}
+
+// kubeConfig is a kubeconfig file.
+// Only the names of the entries are interpreted, everything else is passed through as is so nothing is lost when
+// the file is written back out.
+type kubeConfig map[string]interface{}
+
+// kubeConfigLists are the lists of named entries in a kubeconfig, along with the field each entry keeps its data in.
+var kubeConfigLists = map[string]string{
+	"clusters": "cluster",
+	"users":    "user",
+	"contexts": "context",
+}
+
+// kubeConfigLock serializes changes to the user's kubeconfig, which clusters removed in parallel all edit.
+var kubeConfigLock sync.Mutex
+
+// kubeConfigPrefix is prepended to the cluster name for the entries testrig adds to the user's kubeconfig, so they
+// do not clash with the user's own entries.
+const kubeConfigPrefix = "testrig-"
+
+func readKubeConfig(path string) (kubeConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg kubeConfig
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, errors.Wrapf(err, "error reading kubeconfig %s", path)
+	}
+	if cfg == nil {
+		// An empty file
+		cfg = kubeConfig{}
+	}
+	return cfg, nil
+}
+
+// writeKubeConfig writes the kubeconfig to a temp file which is then renamed into place, so the kubeconfig is never
+// left half written.
+func writeKubeConfig(path string, cfg kubeConfig) error {
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		return errors.Wrap(err, "error marshalling kubeconfig")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return errors.Wrap(err, "error creating kubeconfig dir")
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".testrig-")
+	if err != nil {
+		return errors.Wrap(err, "error creating temp file for kubeconfig")
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0600)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return errors.Wrapf(err, "error writing kubeconfig %s", path)
+	}
+	return nil
+}
+
+// entries gets the entries in one of the kubeconfig lists.
+func (cfg kubeConfig) entries(list string) []interface{} {
+	entries, _ := cfg[list].([]interface{})
+	return entries
+}
+
+// entry gets the data of the named entry in one of the kubeconfig lists.
+func (cfg kubeConfig) entry(list, name string) interface{} {
+	for _, e := range cfg.entries(list) {
+		if m, ok := e.(map[string]interface{}); ok && m["name"] == name {
+			return m[kubeConfigLists[list]]
+		}
+	}
+	return nil
+}
+
+// set adds the named entry to one of the kubeconfig lists, replacing any entry with the same name.
+func (cfg kubeConfig) set(list, name string, data interface{}) {
+	cfg.remove(list, name)
+	cfg[list] = append(cfg.entries(list), map[string]interface{}{"name": name, kubeConfigLists[list]: data})
+}
+
+func (cfg kubeConfig) remove(list, name string) {
+	entries := []interface{}{}
+	for _, e := range cfg.entries(list) {
+		if m, ok := e.(map[string]interface{}); ok && m["name"] == name {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	cfg[list] = entries
+}
+
+// mergeKubeConfig adds the cluster, user and context from the current context of the kubeconfig at src to the one
+// at dst, which is created if it does not exist. All the entries are named after the cluster, see kubeConfigPrefix.
+func mergeKubeConfig(name, src, dst string, use bool) error {
+	kubeConfigLock.Lock()
+	defer kubeConfigLock.Unlock()
+
+	from, err := readKubeConfig(src)
+	if err != nil {
+		return err
+	}
+	current, _ := from["current-context"].(string)
+	if current == "" {
+		if contexts := from.entries("contexts"); len(contexts) == 1 {
+			if m, ok := contexts[0].(map[string]interface{}); ok {
+				current, _ = m["name"].(string)
+			}
+		}
+	}
+	kubeContext, _ := from.entry("contexts", current).(map[string]interface{})
+	if kubeContext == nil {
+		return errors.Errorf("no current context in kubeconfig %s", src)
+	}
+	clusterName, _ := kubeContext["cluster"].(string)
+	userName, _ := kubeContext["user"].(string)
+	kubeCluster, kubeUser := from.entry("clusters", clusterName), from.entry("users", userName)
+	if kubeCluster == nil || kubeUser == nil {
+		return errors.Errorf("kubeconfig %s is missing the cluster or user for context %q", src, current)
+	}
+
+	to, err := readKubeConfig(dst)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		to = kubeConfig{"apiVersion": "v1", "kind": "Config"}
+	}
+
+	entry := kubeConfigPrefix + name
+	newContext := make(map[string]interface{}, len(kubeContext))
+	for k, v := range kubeContext {
+		newContext[k] = v
+	}
+	newContext["cluster"] = entry
+	newContext["user"] = entry
+
+	to.set("clusters", entry, kubeCluster)
+	to.set("users", entry, kubeUser)
+	to.set("contexts", entry, newContext)
+	if use {
+		to["current-context"] = entry
+	}
+	return writeKubeConfig(dst, to)
+}
+
+// unmergeKubeConfig removes the entries for a cluster added by mergeKubeConfig.
+// If the cluster is the current context, the current context is unset.
+func unmergeKubeConfig(name, path string) error {
+	kubeConfigLock.Lock()
+	defer kubeConfigLock.Unlock()
+
+	cfg, err := readKubeConfig(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	entry := kubeConfigPrefix + name
+	for list := range kubeConfigLists {
+		cfg.remove(list, entry)
+	}
+	if cfg["current-context"] == entry {
+		cfg["current-context"] = ""
+	}
+	return writeKubeConfig(path, cfg)
+}
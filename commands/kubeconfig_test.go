@@ -0,0 +1,179 @@
+package commands
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// clusterKubeConfigYAML is an admin kubeconfig like the one acs-engine generates for a cluster.
+const clusterKubeConfigYAML = `apiVersion: v1
+kind: Config
+current-context: %[1]s
+clusters:
+- name: %[1]s
+  cluster:
+    server: https://%[1]s.eastus.cloudapp.azure.com
+contexts:
+- name: %[1]s
+  context:
+    cluster: %[1]s
+    user: %[1]s-admin
+users:
+- name: %[1]s-admin
+  user:
+    token: secret
+`
+
+func writeTestKubeConfig(t *testing.T, dir, name string) string {
+	path := filepath.Join(dir, name+".yaml")
+	if err := ioutil.WriteFile(path, []byte(fmt.Sprintf(clusterKubeConfigYAML, name)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func readTestKubeConfig(t *testing.T, path string) kubeConfig {
+	cfg, err := readKubeConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestMergeKubeConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testrig-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The user already has a context with the same name as the cluster, which must be left alone.
+	dst := writeTestKubeConfig(t, dir, "dev")
+	src := writeTestKubeConfig(t, dir, "dev-cluster")
+
+	if err := mergeKubeConfig("dev", src, dst, false); err != nil {
+		t.Fatal(err)
+	}
+	cfg := readTestKubeConfig(t, dst)
+	for list := range kubeConfigLists {
+		if cfg.entry(list, "testrig-dev") == nil {
+			t.Errorf("expected testrig-dev to be added to %s", list)
+		}
+	}
+	if cfg.entry("contexts", "dev") == nil {
+		t.Fatal("the user's own context should not be touched")
+	}
+	if cfg["current-context"] != "dev" {
+		t.Fatalf("current context should not change without use, got %v", cfg["current-context"])
+	}
+	ctx, _ := cfg.entry("contexts", "testrig-dev").(map[string]interface{})
+	if ctx["cluster"] != "testrig-dev" || ctx["user"] != "testrig-dev" {
+		t.Fatalf("expected context to refer to the merged cluster and user, got %v", ctx)
+	}
+
+	if err := mergeKubeConfig("dev", src, dst, true); err != nil {
+		t.Fatal(err)
+	}
+	cfg = readTestKubeConfig(t, dst)
+	if cfg["current-context"] != "testrig-dev" {
+		t.Fatalf("expected current context to be switched, got %v", cfg["current-context"])
+	}
+	if n := len(cfg.entries("contexts")); n != 2 {
+		t.Fatalf("merging again should replace the entries, got %d contexts", n)
+	}
+
+	if err := unmergeKubeConfig("dev", dst); err != nil {
+		t.Fatal(err)
+	}
+	cfg = readTestKubeConfig(t, dst)
+	for list := range kubeConfigLists {
+		if cfg.entry(list, "testrig-dev") != nil {
+			t.Errorf("expected testrig-dev to be removed from %s", list)
+		}
+	}
+	if cfg.entry("contexts", "dev") == nil || cfg.entry("clusters", "dev") == nil {
+		t.Fatal("the user's own entries should not be removed")
+	}
+	if cfg["current-context"] != "" {
+		t.Fatalf("expected current context to be unset, got %v", cfg["current-context"])
+	}
+}
+
+func TestMergeKubeConfigEmpty(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testrig-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dst := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(dst, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := unmergeKubeConfig("test", dst); err != nil {
+		t.Fatal(err)
+	}
+
+	src := writeTestKubeConfig(t, dir, "test")
+	if err := mergeKubeConfig("test", src, dst, true); err != nil {
+		t.Fatal(err)
+	}
+	if cfg := readTestKubeConfig(t, dst); cfg["current-context"] != "testrig-test" {
+		t.Fatalf("expected merged context to be current, got %v", cfg["current-context"])
+	}
+
+	missing := filepath.Join(dir, "missing", "config")
+	if err := unmergeKubeConfig("test", missing); err != nil {
+		t.Fatal(err)
+	}
+	if err := mergeKubeConfig("test", src, missing, false); err != nil {
+		t.Fatal(err)
+	}
+	if cfg := readTestKubeConfig(t, missing); cfg.entry("clusters", "testrig-test") == nil {
+		t.Fatal("expected kubeconfig to be created with the cluster in it")
+	}
+}
+
+func TestMergeKubeConfigConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testrig-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dst := writeTestKubeConfig(t, dir, "mine")
+	names := make([]string, 16)
+	for i := range names {
+		names[i] = fmt.Sprintf("c%d", i)
+		src := writeTestKubeConfig(t, dir, names[i])
+		if err := mergeKubeConfig(names[i], src, dst, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Clusters removed in parallel all unmerge at once.
+	var wg sync.WaitGroup
+	errs := make([]error, len(names))
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			errs[i] = unmergeKubeConfig(name, dst)
+		}(i, name)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := readTestKubeConfig(t, dst)
+	if n := len(cfg.entries("contexts")); n != 1 || cfg.entry("contexts", "mine") == nil {
+		t.Fatalf("expected only the user's own context to be left, got %v", cfg.entries("contexts"))
+	}
+}
@@ -3,111 +3,455 @@ package commands
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
 	"io"
-	"io/ioutil"
 	"path/filepath"
 	"sort"
 	"strings"
 	"text/tabwriter"
+	"text/template"
+	"time"
 
+	"github.com/Azure/azure-sdk-for-go/profiles/latest/resources/mgmt/resources"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/ghodss/yaml"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 )
 
 // List returns a command to list the existing clusters.
-// Note that this lists from the local state, which may differ from state in Azure.
-func List(ctx context.Context, stateDir string) *cobra.Command {
+// Note that by default this lists from the local state, which may differ from state in Azure.
+// Use `--remote` to compare the local state with the resource groups in Azure.
+func List(ctx context.Context, stateDir string, cfg *UserConfig) *cobra.Command {
+	var (
+		opts           listOpts
+		subscriptionID string
+		cloud          string
+	)
+
 	cmd := &cobra.Command{
-		Use:   "ls",
+		Use:   "ls [pattern...]",
 		Short: "List available clusters",
-		Args:  cobra.NoArgs,
+		Args:  cobra.ArbitraryArgs,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return runList(ctx, stateDir, cmd.OutOrStdout(), cmd.OutOrStderr())
+			opts.Selector.Patterns = args
+			if err := opts.Selector.validate(); err != nil {
+				return err
+			}
+			opts.FallbackSubscription = func() (string, error) {
+				return resolveSubscription(subscriptionID, cfg)
+			}
+			opts.FallbackCloud = func() (string, *azure.Environment, error) {
+				return resolveCloud(cloud, cfg)
+			}
+			if opts.Format != "" && opts.Output != "" {
+				return errors.New("--format and --output cannot be used together")
+			}
+			switch opts.Output {
+			case "", listOutputWide, listOutputJSON, listOutputYAML, listOutputName:
+			default:
+				return errors.Errorf("invalid value for --output: %q, must be one of: wide, json, yaml, name", opts.Output)
+			}
+			return runList(ctx, stateDir, opts, cmd.OutOrStdout(), cmd.OutOrStderr())
 		},
 	}
+
+	flags := cmd.Flags()
+	flags.BoolVar(&opts.Remote, "remote", false, "Compare the local clusters with the testrig resource groups in Azure")
+	flags.StringVarP(&subscriptionID, "subscription", "s", "", "Subscription to list resource groups from with --remote, in addition to the subscriptions of the local clusters")
+	flags.StringVar(&cloud, "cloud", "", "Cloud of the subscription set with --subscription, defaults to the cloud selected in the azure CLI")
+	flags.StringVarP(&opts.Output, "output", "o", "", "Output format, one of: wide, json, yaml, name")
+	opts.Selector.addFlags(flags)
+	flags.StringVar(&opts.Format, "format", "", "Go template to render each cluster with, e.g. '{{.Name}} {{.Location}}'")
 	return cmd
 }
 
-var header = []byte("NAME\tSTATUS\tFQDN\n")
+type listOpts struct {
+	Remote bool
+	// Output is one of the listOutput formats, or empty for the default table
+	Output string
+	// Format is a Go template which is executed for each cluster instead of writing a table
+	Format               string
+	Selector             clusterSelector
+	FallbackSubscription func() (string, error)
+	FallbackCloud        func() (string, *azure.Environment, error)
+}
+
+// Values for listOpts.Output
+const (
+	listOutputWide = "wide"
+	listOutputJSON = "json"
+	listOutputYAML = "yaml"
+	listOutputName = "name"
+)
+
+// maxMessageLen is how much of the failure message is shown in the wide output.
+const maxMessageLen = 60
+
+// Values for listItem.Remote
+const (
+	remoteOK         = "ok"
+	remoteLocalOnly  = "local only"
+	remoteRemoteOnly = "remote only"
+)
 
 type listItem struct {
 	Name   string
 	Status status
+	Reason string
 	FQDN   string
+	// Remote is only set when listing with `--remote`
+	Remote string `json:",omitempty"`
+
+	Location      string
+	ResourceGroup string
+	CreatedAt     *time.Time `json:",omitempty"`
+	// The rest is from the API model, which is only read when the output needs it
+	KubernetesVersion string   `json:",omitempty"`
+	LeaderCount       int      `json:",omitempty"`
+	LeaderSKU         string   `json:",omitempty"`
+	AgentCount        int      `json:",omitempty"`
+	AgentSKUs         []string `json:",omitempty"`
+	FailureMessage    string   `json:",omitempty"`
+
+	state state
 }
 
-func runList(ctx context.Context, stateDir string, outW, errW io.Writer) error {
-	buf := bytes.NewBuffer(nil)
-	tw := tabwriter.NewWriter(buf, 20, 1, 3, ' ', tabwriter.TabIndent)
+func newListItem(name string, s state) listItem {
+	i := listItem{
+		Name:           name,
+		Status:         s.Status,
+		Reason:         s.failureReason(),
+		FQDN:           makeFQDN(s),
+		Location:       s.Location,
+		ResourceGroup:  s.ResourceGroup,
+		FailureMessage: s.FailureMessage,
+		state:          s,
+	}
+	if !s.CreatedAt.IsZero() {
+		createdAt := s.CreatedAt
+		i.CreatedAt = &createdAt
+	}
+	return i
+}
 
-	if _, err := tw.Write(header); err != nil {
-		return errors.Wrap(err, "error writing table header4")
+// setModel sets the fields of the item which come from the API model.
+func (i *listItem) setModel(m apiModel) {
+	p := m.Properties
+	if p == nil {
+		return
+	}
+	if p.OrchestratorProfile != nil {
+		i.KubernetesVersion = p.OrchestratorProfile.OrchestratorRelease
 	}
+	if p.MasterProfile != nil && i.state.Provisioner != provisionerAKS {
+		i.LeaderCount = p.MasterProfile.Count
+		i.LeaderSKU = p.MasterProfile.VMSize
+	}
+	seen := make(map[string]bool)
+	for _, pool := range p.AgentPoolProfiles {
+		i.AgentCount += pool.Count
+		if !seen[pool.VMSize] {
+			seen[pool.VMSize] = true
+			i.AgentSKUs = append(i.AgentSKUs, pool.VMSize)
+		}
+	}
+}
 
-	ls, err := ioutil.ReadDir(stateDir)
+func runList(ctx context.Context, stateDir string, opts listOpts, outW, errW io.Writer) error {
+	resumeRemovals(ctx, stateDir, errW)
+
+	names, err := listClusters(stateDir)
 	if err != nil {
-		return errors.Wrapf(err, "error reading state dir %q", stateDir)
+		return err
 	}
 
 	var items []listItem
 	var errs []error
-	for _, e := range ls {
+	for _, name := range names {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 		default:
 		}
 
-		if !e.IsDir() {
-			continue
-		}
-		if strings.HasSuffix(e.Name(), ".removing") {
-			continue
-		}
-
-		dir := filepath.Join(stateDir, e.Name())
+		dir := filepath.Join(stateDir, name)
 
 		s, err := readState(dir)
 		if err != nil {
-			errs = append(errs, errors.Wrapf(err, "error reading state for %q", e.Name()))
+			errs = append(errs, errors.Wrapf(err, "error reading state for %q", name))
 		}
 
-		items = append(items, listItem{
-			Name:   e.Name(),
-			Status: s.Status,
-			FQDN:   makeFQDN(s),
-		})
+		item := newListItem(name, s)
+		if (opts.Output != "" && opts.Output != listOutputName) || opts.Format != "" {
+			// The model is written after the state, so it may not be there yet.
+			if model, err := readAPIModel(dir); err == nil {
+				item.setModel(model)
+			}
+		}
+		items = append(items, item)
+	}
+
+	if opts.Remote {
+		var remoteErrs []error
+		items, remoteErrs = joinRemote(ctx, items, opts)
+		errs = append(errs, remoteErrs...)
+	}
+
+	if !opts.Selector.empty() {
+		now := time.Now()
+		selected := items[:0]
+		for _, i := range items {
+			if opts.Selector.matches(i.Name, i.state, now) {
+				selected = append(selected, i)
+			}
+		}
+		items = selected
 	}
 
 	sort.Slice(items, func(i, j int) bool {
 		return items[i].Name < items[j].Name
 	})
 
-	for _, i := range items {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
+	buf := bytes.NewBuffer(nil)
+	if err := writeList(buf, items, opts); err != nil {
+		return err
+	}
+
+	for i, err := range errs {
+		io.WriteString(errW, err.Error()+"\n")
+		if i == len(errs)-1 {
+			io.WriteString(errW, "\n")
 		}
+	}
 
+	io.Copy(outW, buf)
+
+	return nil
+}
+
+// writeList writes out the clusters in the format selected in the opts.
+func writeList(w io.Writer, items []listItem, opts listOpts) error {
+	if opts.Format != "" {
+		tmpl, err := template.New("format").Parse(opts.Format)
+		if err != nil {
+			return errors.Wrap(err, "error parsing --format template")
+		}
+		for _, i := range items {
+			if err := tmpl.Execute(w, i); err != nil {
+				return errors.Wrap(err, "error executing --format template")
+			}
+			io.WriteString(w, "\n")
+		}
+		return nil
+	}
+
+	switch opts.Output {
+	case listOutputJSON:
+		if items == nil {
+			items = []listItem{}
+		}
+		data, err := json.MarshalIndent(items, "", "\t")
+		if err != nil {
+			return errors.Wrap(err, "error marshaling clusters")
+		}
+		w.Write(data)
+		io.WriteString(w, "\n")
+		return nil
+	case listOutputYAML:
+		if items == nil {
+			items = []listItem{}
+		}
+		data, err := yaml.Marshal(items)
+		if err != nil {
+			return errors.Wrap(err, "error marshaling clusters")
+		}
+		w.Write(data)
+		return nil
+	case listOutputName:
+		for _, i := range items {
+			io.WriteString(w, i.Name+"\n")
+		}
+		return nil
+	}
+
+	wide := opts.Output == listOutputWide
+	tw := tabwriter.NewWriter(w, 20, 1, 3, ' ', tabwriter.TabIndent)
+	h := "NAME\tSTATUS\tFQDN"
+	if opts.Remote {
+		h += "\tREMOTE"
+	}
+	if wide {
+		h += "\tLOCATION\tRESOURCE GROUP\tAGE\tVERSION\tLEADERS\tAGENTS\tLEADER SKU\tAGENT SKUS\tMESSAGE"
+	}
+	if _, err := io.WriteString(tw, h+"\n"); err != nil {
+		return errors.Wrap(err, "error writing table header")
+	}
+
+	now := time.Now()
+	for _, i := range items {
 		io.WriteString(tw, i.Name+"\t")
-		io.WriteString(tw, strings.Title(string(i.Status))+"\t")
+		st := strings.Title(string(i.Status))
+		if i.Reason != "" {
+			st += " (" + i.Reason + ")"
+		}
+		io.WriteString(tw, st+"\t")
 		io.WriteString(tw, i.FQDN)
+		if opts.Remote {
+			io.WriteString(tw, "\t"+i.Remote)
+		}
+		if wide {
+			var age string
+			if i.CreatedAt != nil {
+				age = formatAge(now.Sub(*i.CreatedAt))
+			}
+			msg := strings.Join(strings.Fields(i.FailureMessage), " ")
+			if len(msg) > maxMessageLen {
+				msg = msg[:maxMessageLen-3] + "..."
+			}
+			fmt.Fprintf(tw, "\t%s\t%s\t%s\t%s\t%d\t%d\t%s\t%s\t%s",
+				i.Location, i.ResourceGroup, age, i.KubernetesVersion, i.LeaderCount, i.AgentCount, i.LeaderSKU, strings.Join(i.AgentSKUs, ","), msg)
+		}
 		io.WriteString(tw, "\n")
 	}
 
-	if err := tw.Flush(); err != nil {
-		return errors.Wrap(err, "error flushing table writer")
+	return errors.Wrap(tw.Flush(), "error flushing table writer")
+}
+
+// formatAge formats a duration in its largest unit, e.g. 3d or 5h.
+func formatAge(d time.Duration) string {
+	switch {
+	case d >= 24*time.Hour:
+		return fmt.Sprintf("%dd", int(d/(24*time.Hour)))
+	case d >= time.Hour:
+		return fmt.Sprintf("%dh", int(d/time.Hour))
+	case d >= time.Minute:
+		return fmt.Sprintf("%dm", int(d/time.Minute))
+	default:
+		return fmt.Sprintf("%ds", int(d/time.Second))
 	}
+}
 
-	for i, err := range errs {
-		io.WriteString(errW, err.Error()+"\n")
-		if i == len(errs)-1 {
-			io.WriteString(errW, "\n")
+// joinRemote matches up the local clusters with the testrig resource groups in Azure.
+// Resource groups are listed from every subscription (and cloud) used by a local cluster as well as the fallback
+// subscription.
+// Local clusters with no resource group are marked as "local only", resource groups with no local cluster are added
+// to the list as "remote only".
+func joinRemote(ctx context.Context, items []listItem, opts listOpts) ([]listItem, []error) {
+	var errs []error
+
+	// scopes are the subscriptions to list, as a state with just the subscription and cloud set.
+	var scopes []state
+	seen := make(map[string]bool)
+	addScope := func(s state) {
+		if s.SubscriptionID == "" {
+			return
+		}
+		scope := state{SubscriptionID: s.SubscriptionID, Cloud: s.Cloud, CloudEnvironment: s.CloudEnvironment}
+		key, err := scopeKey(scope)
+		if err != nil {
+			errs = append(errs, err)
+			return
+		}
+		if !seen[key] {
+			seen[key] = true
+			scopes = append(scopes, scope)
 		}
 	}
 
-	io.Copy(outW, buf)
+	needFallback := len(items) == 0
+	for _, i := range items {
+		addScope(i.state)
+		if i.state.SubscriptionID == "" {
+			needFallback = true
+		}
+	}
+	fallback, err := opts.FallbackSubscription()
+	if err != nil && needFallback {
+		errs = append(errs, err)
+	}
+	cloud, customEnv, err := opts.FallbackCloud()
+	if err != nil {
+		errs = append(errs, err)
+	} else {
+		addScope(state{SubscriptionID: fallback, Cloud: cloud, CloudEnvironment: customEnv})
+	}
 
-	return nil
+	// Keyed by scope, then resource group name (lower cased since Azure is case insensitive).
+	groups := make(map[string]map[string]resources.Group)
+	for _, scope := range scopes {
+		client, err := newBackend().groups(scope)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		ls, err := client.ListByTag(ctx, tagCluster)
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "error listing resource groups in subscription %q", scope.SubscriptionID))
+			continue
+		}
+		key, _ := scopeKey(scope)
+		groups[key] = make(map[string]resources.Group, len(ls))
+		for _, g := range ls {
+			if g.Name != nil {
+				groups[key][strings.ToLower(*g.Name)] = g
+			}
+		}
+	}
+
+	for i := range items {
+		scope := items[i].state
+		if scope.SubscriptionID == "" {
+			scope = state{SubscriptionID: fallback, Cloud: cloud, CloudEnvironment: customEnv}
+		}
+		key, err := scopeKey(scope)
+		if err != nil {
+			continue
+		}
+		scopeGroups, ok := groups[key]
+		if !ok {
+			// Could not list this subscription, so we don't know.
+			continue
+		}
+		rg := strings.ToLower(items[i].state.ResourceGroup)
+		if _, ok := scopeGroups[rg]; ok {
+			items[i].Remote = remoteOK
+			delete(scopeGroups, rg)
+			continue
+		}
+		items[i].Remote = remoteLocalOnly
+	}
+
+	for _, scope := range scopes {
+		key, _ := scopeKey(scope)
+		for _, g := range groups[key] {
+			s := scope
+			if g.Name != nil {
+				s.ResourceGroup = *g.Name
+				s.DNSPrefix = *g.Name
+			}
+			if g.Location != nil {
+				s.Location = *g.Location
+			}
+			name := s.ResourceGroup
+			if v := g.Tags[tagCluster]; v != nil {
+				name = *v
+			}
+			item := newListItem(name, s)
+			item.Remote = remoteRemoteOnly
+			items = append(items, item)
+		}
+	}
+
+	return items, errs
+}
+
+// scopeKey identifies the subscription and cloud of a cluster.
+func scopeKey(s state) (string, error) {
+	env, err := s.environment()
+	if err != nil {
+		return "", err
+	}
+	return env.ResourceManagerEndpoint + "|" + s.SubscriptionID, nil
 }
@@ -0,0 +1,125 @@
+package commands
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testEngineEnv makes the test binary act as acs-engine, see fakeEngine.
+const testEngineEnv = "TESTRIG_TEST_ENGINE"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(testEngineEnv) != "" {
+		os.Exit(fakeEngine(os.Args[1:]))
+	}
+	// Inherited by the engine when the tests run it.
+	os.Setenv(testEngineEnv, "1")
+	os.Setenv(fakeDeployTimeEnv, "100ms")
+	os.Exit(m.Run())
+}
+
+// fakeEngine implements enough of `acs-engine generate` for clusters to be deployed to the fake backend.
+func fakeEngine(args []string) int {
+	var out string
+	for i := 0; i < len(args)-1; i++ {
+		if args[i] == "--output-directory" {
+			out = args[i+1]
+		}
+	}
+	if len(args) == 0 || args[0] != "generate" || out == "" {
+		os.Stderr.WriteString("unsupported command\n")
+		return 1
+	}
+
+	files := map[string]string{
+		"azuredeploy.json":            `{"resources":[{"type":"Microsoft.Network/virtualNetworks","name":"vnet"},{"type":"Microsoft.Compute/virtualMachines","name":"k8s-master-0"}]}`,
+		"azuredeploy.parameters.json": `{"parameters":{"masterCount":{"value":1}}}`,
+	}
+	if err := os.MkdirAll(out, 0755); err != nil {
+		os.Stderr.WriteString(err.Error() + "\n")
+		return 1
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(out, name), []byte(data), 0644); err != nil {
+			os.Stderr.WriteString(err.Error() + "\n")
+			return 1
+		}
+	}
+	return 0
+}
+
+// testEnv is a state dir and a fake Azure backend for a test.
+type testEnv struct {
+	t        *testing.T
+	dir      string
+	stateDir string
+}
+
+// newTestEnv sets up a state dir and points the backend at a fake Azure, call cleanup once done.
+func newTestEnv(t *testing.T) *testEnv {
+	dir, err := ioutil.TempDir("", "testrig-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	FakeAzure = filepath.Join(dir, "azure")
+	return &testEnv{t: t, dir: dir, stateDir: filepath.Join(dir, "state")}
+}
+
+func (e *testEnv) cleanup() {
+	FakeAzure = ""
+	os.Unsetenv(fakeFailEnv)
+	os.RemoveAll(e.dir)
+}
+
+// fail has the given fake backend operations fail, see fakeFailEnv.
+func (e *testEnv) fail(ops string) {
+	os.Setenv(fakeFailEnv, ops)
+}
+
+func (e *testEnv) createOpts() createOpts {
+	return createOpts{
+		StateDir:       e.stateDir,
+		Model:          defaultModel(),
+		Engines:        enginePaths{ACSEngine: os.Args[0]},
+		Location:       "eastus",
+		SubscriptionID: "sub",
+		Cloud:          defaultAzCloud,
+		ReadyTimeout:   time.Minute,
+	}
+}
+
+// create creates a cluster, failing the test if it cannot be.
+func (e *testEnv) create(name string) state {
+	if err := runCreate(context.Background(), name, e.createOpts(), nil, ioutil.Discard, ioutil.Discard); err != nil {
+		e.t.Fatalf("error creating cluster %s: %v", name, err)
+	}
+	return e.state(name)
+}
+
+func (e *testEnv) state(name string) state {
+	s, err := readState(filepath.Join(e.stateDir, name))
+	if err != nil {
+		e.t.Fatalf("error reading state for %s: %v", name, err)
+	}
+	return s
+}
+
+func (e *testEnv) groups() groupsClient {
+	client, err := newBackend().groups(state{SubscriptionID: "sub"})
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return client
+}
+
+func (e *testEnv) groupExists(group string) bool {
+	exists, err := e.groups().Exists(context.Background(), group)
+	if err != nil {
+		e.t.Fatalf("error checking for resource group %s: %v", group, err)
+	}
+	return exists
+}
@@ -0,0 +1,195 @@
+package commands
+
+import (
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// UnmarshalJSON decodes the model, keeping the full document around so that fields unknown to apiModel are
+// preserved when the model is written back out.
+func (m *apiModel) UnmarshalJSON(data []byte) error {
+	type model apiModel
+	if err := json.Unmarshal(data, (*model)(m)); err != nil {
+		return err
+	}
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	m.raw = raw
+	return nil
+}
+
+// MarshalJSON encodes the model, merged on top of the document it was decoded from (if any).
+func (m apiModel) MarshalJSON() ([]byte, error) {
+	type model apiModel
+	data, err := json.Marshal(model(m))
+	if err != nil || m.raw == nil {
+		return data, err
+	}
+
+	var typed map[string]interface{}
+	if err := json.Unmarshal(data, &typed); err != nil {
+		return nil, err
+	}
+	return json.Marshal(mergeModel(m.raw, typed))
+}
+
+// mergeModel merges the typed representation of a model on top of the raw document.
+// Values from typed always win, except that objects are merged recursively so fields only in raw are kept and
+// zero values are only kept for fields which are in raw.
+// Lists of named objects (such as agent pools) are matched up by name, anything not in typed is dropped.
+func mergeModel(raw, typed interface{}) interface{} {
+	switch t := typed.(type) {
+	case map[string]interface{}:
+		r, ok := raw.(map[string]interface{})
+		if !ok {
+			return t
+		}
+		merged := make(map[string]interface{}, len(r))
+		for k, v := range r {
+			merged[k] = v
+		}
+		for k, v := range t {
+			rv, ok := r[k]
+			if !ok && isZeroValue(v) {
+				// Don't add fields the document didn't have just because the typed model has a zero value for it.
+				continue
+			}
+			merged[k] = mergeModel(rv, v)
+		}
+		return merged
+	case []interface{}:
+		r, ok := raw.([]interface{})
+		if !ok {
+			return t
+		}
+		byName := make(map[string]interface{}, len(r))
+		for _, v := range r {
+			if name := itemName(v); name != "" {
+				byName[name] = v
+			}
+		}
+		merged := make([]interface{}, 0, len(t))
+		for _, v := range t {
+			merged = append(merged, mergeModel(byName[itemName(v)], v))
+		}
+		return merged
+	default:
+		return typed
+	}
+}
+
+func isZeroValue(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case float64:
+		return v == 0
+	case bool:
+		return !v
+	}
+	return false
+}
+
+func itemName(v interface{}) string {
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	name, _ := obj["name"].(string)
+	return name
+}
+
+// mergePatch applies a JSON merge patch (RFC 7386) to the target document.
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+			continue
+		}
+		t[k] = mergePatch(t[k], v)
+	}
+	return t
+}
+
+// loadAPIModel reads a user supplied acs-engine API model.
+func loadAPIModel(p string) (*apiModel, error) {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading api model")
+	}
+	var m apiModel
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, errors.Wrap(err, "error unmarshaling api model")
+	}
+	if err := validateModel(&m); err != nil {
+		return nil, errors.Wrap(err, "invalid api model")
+	}
+	return &m, nil
+}
+
+// applyModelPatch applies the JSON merge patch in the file at p to the model.
+func applyModelPatch(m *apiModel, p string) error {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return errors.Wrap(err, "error reading model patch")
+	}
+	var patch interface{}
+	if err := json.Unmarshal(data, &patch); err != nil {
+		return errors.Wrap(err, "error unmarshaling model patch")
+	}
+
+	modelJSON, err := json.Marshal(m)
+	if err != nil {
+		return errors.Wrap(err, "error marshalling api model")
+	}
+	var doc interface{}
+	if err := json.Unmarshal(modelJSON, &doc); err != nil {
+		return errors.Wrap(err, "error unmarshaling api model")
+	}
+
+	patched, err := json.Marshal(mergePatch(doc, patch))
+	if err != nil {
+		return errors.Wrap(err, "error marshalling patched api model")
+	}
+	var pm apiModel
+	if err := json.Unmarshal(patched, &pm); err != nil {
+		return errors.Wrap(err, "error unmarshaling patched api model")
+	}
+	if err := validateModel(&pm); err != nil {
+		return errors.Wrap(err, "invalid api model after applying patch")
+	}
+	*m = pm
+	return nil
+}
+
+// validateModel makes sure the parts of the model which testrig needs to fill in are present.
+func validateModel(m *apiModel) error {
+	switch {
+	case m.Properties == nil:
+		return errors.New("missing properties")
+	case m.Properties.OrchestratorProfile == nil:
+		return errors.New("missing properties.orchestratorProfile")
+	case m.Properties.MasterProfile == nil:
+		return errors.New("missing properties.masterProfile")
+	case m.Properties.LinuxProfile == nil:
+		return errors.New("missing properties.linuxProfile")
+	}
+	if m.Properties.OrchestratorProfile.KubernetesConfig == nil {
+		m.Properties.OrchestratorProfile.KubernetesConfig = &kubernetesConfig{}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package commands
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+)
+
+// plan describes what `create` would deploy.
+type plan struct {
+	Name          string
+	Location      string
+	ResourceGroup string
+	Provisioner   string
+	Model         *apiModel
+	TemplatePath  string
+}
+
+var planPoolHeader = []byte("\tNAME\tOS\tCOUNT\tSKU\tAVAILABILITY\n")
+
+func writePlan(outW io.Writer, p plan) error {
+	buf := bytes.NewBuffer(nil)
+	tw := tabwriter.NewWriter(buf, 0, 1, 3, ' ', 0)
+
+	props := p.Model.Properties
+	k8s := props.OrchestratorProfile.KubernetesConfig
+
+	fmt.Fprintf(tw, "Cluster:\t%s\n", p.Name)
+	fmt.Fprintf(tw, "Location:\t%s\n", p.Location)
+	fmt.Fprintf(tw, "Resource group:\t%s\n", p.ResourceGroup)
+	fmt.Fprintf(tw, "Provisioner:\t%s\n", p.Provisioner)
+	fmt.Fprintf(tw, "DNS prefix:\t%s\n", props.MasterProfile.DNSPrefix)
+	fmt.Fprintf(tw, "Kubernetes version:\t%s\n", props.OrchestratorProfile.OrchestratorRelease)
+	fmt.Fprintf(tw, "Network plugin:\t%s\n", k8s.NetworkPlugin)
+	fmt.Fprintf(tw, "Network policy:\t%s\n", k8s.NetworkPolicy)
+	if k8s.ContainerRuntime != "" {
+		fmt.Fprintf(tw, "Container runtime:\t%s\n", k8s.ContainerRuntime)
+	}
+	if p.Provisioner != provisionerAKS {
+		fmt.Fprintf(tw, "Leaders:\t%d x %s\n", props.MasterProfile.Count, props.MasterProfile.VMSize)
+	}
+	if err := tw.Flush(); err != nil {
+		return errors.Wrap(err, "error flushing table writer")
+	}
+
+	io.WriteString(buf, "Agent pools:\n")
+	tw = tabwriter.NewWriter(buf, 0, 1, 3, ' ', 0)
+	if _, err := tw.Write(planPoolHeader); err != nil {
+		return errors.Wrap(err, "error writing table header")
+	}
+	for _, pool := range props.AgentPoolProfiles {
+		io.WriteString(tw, "\t"+pool.Name+"\t")
+		io.WriteString(tw, pool.OSType+"\t")
+		io.WriteString(tw, strconv.Itoa(pool.Count)+"\t")
+		io.WriteString(tw, pool.VMSize+"\t")
+		io.WriteString(tw, pool.AvailabilityProfile)
+		io.WriteString(tw, "\n")
+	}
+	if err := tw.Flush(); err != nil {
+		return errors.Wrap(err, "error flushing table writer")
+	}
+
+	fmt.Fprintf(buf, "Generated deployment: %s\n", p.TemplatePath)
+
+	_, err := io.Copy(outW, buf)
+	return err
+}
@@ -0,0 +1,159 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/profiles/latest/resources/mgmt/resources"
+	"github.com/pkg/errors"
+)
+
+// progressInterval is how often deployment operations are polled to report progress.
+var progressInterval = 10 * time.Second
+
+// deploymentProgress reports on the individual operations of an ARM deployment as they change state.
+type deploymentProgress struct {
+	client     deploymentsClient
+	group      string
+	deployment string
+	out        io.Writer
+
+	states  map[string]string
+	started map[string]time.Time
+}
+
+func newDeploymentProgress(client deploymentsClient, group, deployment string, out io.Writer) *deploymentProgress {
+	return &deploymentProgress{
+		client:     client,
+		group:      group,
+		deployment: deployment,
+		out:        out,
+		states:     make(map[string]string),
+		started:    make(map[string]time.Time),
+	}
+}
+
+// watch polls the deployment operations until the context is cancelled.
+// Errors from polling are ignored since progress reporting is best effort.
+func (p *deploymentProgress) watch(ctx context.Context, interval time.Duration) {
+	for {
+		p.poll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// poll fetches the current deployment operations and writes out any which changed since the last poll.
+func (p *deploymentProgress) poll(ctx context.Context) error {
+	ops, err := listDeploymentOperations(ctx, p.client, p.group, p.deployment)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, op := range ops {
+		if op.OperationID == nil || op.Properties == nil || op.Properties.ProvisioningState == nil {
+			continue
+		}
+		id := *op.OperationID
+		provisioningState := *op.Properties.ProvisioningState
+		if p.states[id] == provisioningState {
+			continue
+		}
+		p.states[id] = provisioningState
+
+		msg := strings.ToLower(provisioningState)
+		switch provisioningState {
+		case "Succeeded", "Failed", "Canceled":
+			if started, ok := p.started[id]; ok {
+				msg += " after " + now.Sub(started).Round(time.Second).String()
+			}
+		default:
+			if _, ok := p.started[id]; !ok {
+				p.started[id] = now
+				msg = "started"
+			}
+		}
+		fmt.Fprintf(p.out, "%s: %s\n", operationResourceName(op), msg)
+	}
+	return nil
+}
+
+func listDeploymentOperations(ctx context.Context, client deploymentsClient, group, deployment string) ([]resources.DeploymentOperation, error) {
+	ops, err := client.ListOperations(ctx, group, deployment)
+	return ops, errors.Wrapf(err, "error listing operations for deployment %q", deployment)
+}
+
+// deploymentFailures gets the errors for all failed operations in a deployment.
+func deploymentFailures(ctx context.Context, client deploymentsClient, group, deployment string) ([]failureDetail, error) {
+	ops, err := listDeploymentOperations(ctx, client, group, deployment)
+	if err != nil {
+		return nil, err
+	}
+
+	var failures []failureDetail
+	for _, op := range ops {
+		if op.Properties == nil || op.Properties.ProvisioningState == nil || *op.Properties.ProvisioningState != "Failed" {
+			continue
+		}
+		failures = append(failures, operationFailures(op)...)
+	}
+	return failures, nil
+}
+
+type operationError struct {
+	Code    string
+	Message string
+	Details []operationError
+}
+
+// operationFailures converts the status message of a failed operation into failure details.
+// The status message is free-form JSON, but is generally an ARM error object which may have more specific errors in its details.
+func operationFailures(op resources.DeploymentOperation) []failureDetail {
+	resource := operationResourceName(op)
+
+	var msg struct {
+		Error operationError
+	}
+	data, err := json.Marshal(op.Properties.StatusMessage)
+	if err != nil || json.Unmarshal(data, &msg) != nil || (msg.Error.Code == "" && msg.Error.Message == "") {
+		var code string
+		if op.Properties.StatusCode != nil {
+			code = *op.Properties.StatusCode
+		}
+		return []failureDetail{{Resource: resource, Code: code, Message: string(data)}}
+	}
+
+	if len(msg.Error.Details) == 0 {
+		return []failureDetail{{Resource: resource, Code: msg.Error.Code, Message: msg.Error.Message}}
+	}
+
+	failures := make([]failureDetail, 0, len(msg.Error.Details))
+	for _, d := range msg.Error.Details {
+		failures = append(failures, failureDetail{Resource: resource, Code: d.Code, Message: d.Message})
+	}
+	return failures
+}
+
+// operationResourceName gets a short name for the resource targeted by a deployment operation, e.g. `virtualMachines/k8s-master-0`.
+func operationResourceName(op resources.DeploymentOperation) string {
+	if op.Properties.TargetResource == nil {
+		return "deployment"
+	}
+	var typ, name string
+	if t := op.Properties.TargetResource.ResourceType; t != nil {
+		typ = path.Base(*t)
+	}
+	if n := op.Properties.TargetResource.ResourceName; n != nil {
+		name = *n
+	}
+	return typ + "/" + name
+}
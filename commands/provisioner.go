@@ -0,0 +1,200 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/profiles/latest/resources/mgmt/resources"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/cpuguy83/strongerrors"
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+)
+
+// Provisioner names, these are recorded in the cluster state.
+const (
+	provisionerACSEngine = "acs-engine"
+	provisionerAKSEngine = "aks-engine"
+	provisionerAKS       = "aks"
+)
+
+// provisioner creates and manages the Azure resources for a cluster.
+// The resource group the cluster lives in is managed by the caller, see provisionCluster and removeCluster.
+type provisioner interface {
+	// generate renders whatever is deployed for the cluster's model into the cluster dir, returning its path.
+	// Nothing is re-generated if it already exists, so this can be re-run for a cluster which failed part of the way through.
+	generate(ctx context.Context, c *cluster) (string, error)
+	// deploy deploys the generated cluster into its resource group.
+	// The state is persisted as soon as the deployment is submitted, if detach is set it returns at that point.
+	deploy(ctx context.Context, c *cluster, detach bool) error
+	// scale sets the number of nodes in an agent pool.
+	scale(ctx context.Context, c *cluster, pool string, count int) error
+	// upgrade upgrades the cluster to a different Kubernetes version.
+	upgrade(ctx context.Context, c *cluster, version string) error
+	// delete starts removing the cluster from Azure, use waitDeleted to wait for it to finish.
+	// The future is nil if there was nothing to remove.
+	delete(ctx context.Context, c *cluster) (groupDeleteFuture, error)
+	// kubeConfig gets the path to the admin kubeconfig for the cluster.
+	kubeConfig(ctx context.Context, c *cluster) (string, error)
+}
+
+// enginePaths are the locations of the acs-engine and aks-engine binaries.
+type enginePaths struct {
+	ACSEngine string
+	AKSEngine string
+}
+
+func (p *enginePaths) addFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&p.ACSEngine, "acs-engine-path", "acs-engine", "Location of acs-engine binary")
+	flags.StringVar(&p.AKSEngine, "aks-engine-path", "aks-engine", "Location of aks-engine binary")
+}
+
+// newProvisioner gets the provisioner with the given name.
+// Clusters created before the provisioner was recorded in the state do not have one, these were all created with acs-engine.
+func newProvisioner(name string, engines enginePaths) (provisioner, error) {
+	switch name {
+	case provisionerACSEngine, "":
+		return &engineProvisioner{name: provisionerACSEngine, path: engines.ACSEngine}, nil
+	case provisionerAKSEngine:
+		return &engineProvisioner{name: provisionerAKSEngine, path: engines.AKSEngine}, nil
+	case provisionerAKS:
+		return &aksProvisioner{}, nil
+	default:
+		return nil, errors.Errorf("unknown provisioner %q, must be one of: %s, %s, %s", name, provisionerACSEngine, provisionerAKSEngine, provisionerAKS)
+	}
+}
+
+// cluster is a cluster being operated on by a provisioner.
+type cluster struct {
+	name  string
+	dir   string
+	state *state
+	model *apiModel
+	// errW is where progress is reported to
+	errW io.Writer
+}
+
+// loadReadyCluster loads a cluster which is ready from the state dir.
+func loadReadyCluster(stateDir, name string, errW io.Writer) (*cluster, error) {
+	dir := filepath.Join(stateDir, name)
+	s, err := readState(dir)
+	if err != nil {
+		if strongerrors.IsNotFound(err) {
+			return nil, clusterNotFound(name)
+		}
+		return nil, err
+	}
+	if s.Status != stateReady {
+		return nil, errors.Errorf("cluster is not ready, current state: %s", strings.Title(string(s.Status)))
+	}
+	model, err := readAPIModel(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &cluster{name: name, dir: dir, state: &s, model: &model, errW: errW}, nil
+}
+
+// progress reports progress on an operation on the cluster, prefixed with the cluster name.
+func (c *cluster) progress(format string, args ...interface{}) {
+	if c.errW != nil {
+		fmt.Fprintf(c.errW, "%s: "+format+"\n", append([]interface{}{c.name}, args...)...)
+	}
+}
+
+func (c *cluster) writeState() error {
+	return writeState(c.dir, *c.state)
+}
+
+// azure gets the environment and authorizer for the cloud the cluster is in.
+func (c *cluster) azure() (azure.Environment, autorest.Authorizer, error) {
+	env, err := c.state.environment()
+	if err != nil {
+		return env, nil, err
+	}
+	auth, err := getAuthorizer(env)
+	return env, auth, err
+}
+
+// createResourceGroup creates (or updates) the resource group for the cluster.
+func createResourceGroup(ctx context.Context, c *cluster) error {
+	client, err := newBackend().groups(*c.state)
+	if err != nil {
+		return err
+	}
+	s := c.state
+	if _, err := client.CreateOrUpdate(ctx, s.ResourceGroup, resources.Group{Location: &s.Location, Name: &s.ResourceGroup, Tags: groupTags(c.name, *s)}); err != nil {
+		return errors.Wrapf(err, "error creating resource group %q", s.ResourceGroup)
+	}
+	return nil
+}
+
+// deleteResourceGroup starts deleting the resource group of the cluster and everything in it.
+// A resource group which does not exist is not an error, no future is returned for it.
+func deleteResourceGroup(ctx context.Context, c *cluster) (groupDeleteFuture, error) {
+	client, err := newBackend().groups(*c.state)
+	if err != nil {
+		return nil, err
+	}
+
+	group := c.state.ResourceGroup
+	c.progress("deleting resource group %s", group)
+	var future groupDeleteFuture
+	err = retryThrottled(ctx, c, func() error {
+		var err error
+		future, err = client.Delete(ctx, group)
+		return err
+	})
+	if err != nil {
+		if isAzureNotFound(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "error deleting resource group %q", group)
+	}
+	return future, nil
+}
+
+// waitDeleted waits for the deletion of the cluster's resource group to finish.
+func waitDeleted(ctx context.Context, c *cluster, future groupDeleteFuture) error {
+	group := c.state.ResourceGroup
+	c.progress("waiting for resource group %s to be deleted", group)
+	if err := retryThrottled(ctx, c, func() error { return future.Wait(ctx) }); err != nil && !isAzureNotFound(err) {
+		return errors.Wrapf(err, "error deleting resource group %q", group)
+	}
+	return nil
+}
+
+// Backoff for requests throttled by Azure which do not say how long to wait.
+var (
+	throttleBackoff    = 5 * time.Second
+	maxThrottleBackoff = 2 * time.Minute
+)
+
+// retryThrottled calls f until Azure stops throttling it, waiting between attempts.
+func retryThrottled(ctx context.Context, c *cluster, f func() error) error {
+	backoff := throttleBackoff
+	for {
+		err := f()
+		wait, throttled := azureThrottled(err)
+		if !throttled {
+			return err
+		}
+		if wait == 0 {
+			wait = backoff
+			if backoff *= 2; backoff > maxThrottleBackoff {
+				backoff = maxThrottleBackoff
+			}
+		}
+		c.progress("throttled by Azure, retrying in %s", wait)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// readinessInterval is how often Kubernetes is checked while waiting for it to be ready.
+var readinessInterval = 10 * time.Second
+
+// readiness is the result of checking whether Kubernetes in a cluster is usable.
+type readiness struct {
+	APIServer   bool
+	Nodes       int
+	NodesReady  int
+	Pods        int
+	PodsRunning int
+}
+
+// ready is true when the API server responds, at least the expected number of nodes are Ready and all kube-system pods are running.
+func (r readiness) ready(expectedNodes int) bool {
+	return r.APIServer && r.NodesReady >= expectedNodes && r.Pods > 0 && r.PodsRunning == r.Pods
+}
+
+func (r readiness) String() string {
+	if !r.APIServer {
+		return "waiting for API server"
+	}
+	return fmt.Sprintf("nodes ready: %d/%d, kube-system pods running: %d/%d", r.NodesReady, r.Nodes, r.PodsRunning, r.Pods)
+}
+
+// expectedNodes is the number of nodes the cluster should have once it is up.
+// The leader nodes of AKS clusters are managed by AKS and do not show up as nodes.
+func expectedNodes(c *cluster) int {
+	var n int
+	if c.state.Provisioner != provisionerAKS {
+		n += c.model.Properties.MasterProfile.Count
+	}
+	for _, pool := range c.model.Properties.AgentPoolProfiles {
+		n += pool.Count
+	}
+	return n
+}
+
+// waitKubernetesReady waits for Kubernetes in a provisioned cluster to be ready, reporting progress to the cluster's errW.
+// Progress is only written when it changes.
+func waitKubernetesReady(ctx context.Context, c *cluster, p provisioner, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	expected := expectedNodes(c)
+	var last string
+	for {
+		r, err := checkKubernetes(ctx, c, p)
+		if err != nil {
+			return err
+		}
+		if r.ready(expected) {
+			return nil
+		}
+		if msg := r.String(); msg != last {
+			io.WriteString(c.errW, "Kubernetes: "+msg+"\n")
+			last = msg
+		}
+
+		select {
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return errors.Errorf("timed out waiting for Kubernetes to be ready, %s, expected %d nodes", last, expected)
+			}
+			return ctx.Err()
+		case <-time.After(readinessInterval):
+		}
+	}
+}
+
+// checkKubectl checks kubectl can be found, which is needed to check Kubernetes is ready.
+// It is not needed with the fake Azure backend, see checkKubernetes.
+func checkKubectl() error {
+	if FakeAzure != "" {
+		return nil
+	}
+	if _, err := exec.LookPath("kubectl"); err != nil {
+		return errKubectlNotFound
+	}
+	return nil
+}
+
+var errKubectlNotFound = errors.New("could not find kubectl binary, it is needed to check the cluster is ready")
+
+// checkKubernetes checks how far along Kubernetes in the cluster is using kubectl and the cluster's admin kubeconfig.
+// Failures to reach the API server are not errors, they are reported as the API server not being up yet.
+// There is no Kubernetes behind the fake Azure backend, so clusters deployed to it are always ready unless
+// "kubernetes" is in the operations it fails, in which case the API server never comes up.
+func checkKubernetes(ctx context.Context, c *cluster, p provisioner) (readiness, error) {
+	if FakeAzure != "" {
+		if fakeFails("kubernetes") {
+			return readiness{}, nil
+		}
+		return readiness{APIServer: true, Nodes: expectedNodes(c), NodesReady: expectedNodes(c), Pods: 1, PodsRunning: 1}, nil
+	}
+
+	kubectl, err := exec.LookPath("kubectl")
+	if err != nil {
+		return readiness{}, errKubectlNotFound
+	}
+	kubeConfig, err := p.kubeConfig(ctx, c)
+	if err != nil {
+		return readiness{}, err
+	}
+	get := func(args ...string) ([]byte, error) {
+		return exec.CommandContext(ctx, kubectl, append([]string{"--kubeconfig", kubeConfig, "--request-timeout", "30s"}, args...)...).Output()
+	}
+
+	var r readiness
+	if out, err := get("get", "--raw", "/healthz"); err != nil || strings.TrimSpace(string(out)) != "ok" {
+		return r, nil
+	}
+	r.APIServer = true
+
+	var nodes struct {
+		Items []struct {
+			Status struct {
+				Conditions []struct {
+					Type   string
+					Status string
+				}
+			}
+		}
+	}
+	out, err := get("get", "nodes", "-o", "json")
+	if err != nil {
+		return r, nil
+	}
+	if err := json.Unmarshal(out, &nodes); err != nil {
+		return r, errors.Wrap(err, "error decoding nodes from kubectl")
+	}
+	r.Nodes = len(nodes.Items)
+	for _, n := range nodes.Items {
+		for _, cond := range n.Status.Conditions {
+			if cond.Type == "Ready" && cond.Status == "True" {
+				r.NodesReady++
+			}
+		}
+	}
+
+	var pods struct {
+		Items []struct {
+			Status struct {
+				Phase string
+			}
+		}
+	}
+	out, err = get("get", "pods", "--namespace", "kube-system", "-o", "json")
+	if err != nil {
+		return r, nil
+	}
+	if err := json.Unmarshal(out, &pods); err != nil {
+		return r, errors.Wrap(err, "error decoding pods from kubectl")
+	}
+	r.Pods = len(pods.Items)
+	for _, pod := range pods.Items {
+		// Pods from jobs which have finished count as running.
+		if pod.Status.Phase == "Running" || pod.Status.Phase == "Succeeded" {
+			r.PodsRunning++
+		}
+	}
+	return r, nil
+}
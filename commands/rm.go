@@ -1,16 +1,19 @@
 package commands
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"text/tabwriter"
+	"time"
 
-	"github.com/Azure/azure-sdk-for-go/profiles/latest/resources/mgmt/resources"
 	"github.com/cpuguy83/strongerrors"
-	homedir "github.com/mitchellh/go-homedir"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 )
@@ -19,33 +22,56 @@ import (
 // Note that this will remove the entire resource group!
 func Remove(ctx context.Context, stateDir string, cfg *UserConfig) *cobra.Command {
 	var (
-		force          bool
+		opts           = removeOpts{Parallel: defaultRemoveParallel}
+		all            bool
+		yes            bool
 		subscriptionID string
+		sel            clusterSelector
 	)
 
 	cmd := &cobra.Command{
-		Use:   "rm",
+		Use:   "rm [name|pattern...]",
 		Short: "Remove a cluster",
-		Args:  cobra.MinimumNArgs(1),
+		Long:  "Remove clusters by name, or select them with a name pattern, --filter, --older-than or --all. Selected clusters are listed for confirmation before anything is removed.",
+		Args:  cobra.ArbitraryArgs,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			if subscriptionID == "" {
-				subscriptionID = cfg.Subscription
-				if subscriptionID == "" {
-					home, err := homedir.Dir()
-					if err != nil {
-						return errors.Wrap(err, "error determining home dir while trying to infer subscription ID")
-					}
-					subscriptionID, err = getSubFromAzDir(filepath.Join(home, ".azure"))
-					if err != nil {
-						return errors.Wrap(err, "no subscription provided and could not determine from azure CLI dir")
-					}
+			opts.FallbackSubscription = func() (string, error) {
+				return resolveSubscription(subscriptionID, cfg)
+			}
+			if opts.Parallel < 1 {
+				return errors.New("--parallel must be at least 1")
+			}
+
+			selecting := all || len(sel.Filters) > 0 || sel.OlderThan > 0
+			for _, arg := range args {
+				if isPattern(arg) {
+					selecting = true
 				}
 			}
-			if err := runRemove(ctx, args, stateDir, subscriptionID, force, cmd.OutOrStdout()); err != nil {
-				if !force {
-					if !strongerrors.IsNotFound(err) {
-						io.WriteString(cmd.OutOrStderr(), "Error while attempting remove.\nYou can verify the state details and try again, or use `--force` to remove all local state\n")
-					}
+			if all && len(args) > 0 {
+				return errors.New("--all cannot be used along with cluster names")
+			}
+			if !selecting && len(args) == 0 {
+				return errors.New("must specify the clusters to remove, or select them with --filter, --older-than or --all")
+			}
+
+			names := args
+			if selecting {
+				sel.Patterns = args
+				if err := sel.validate(); err != nil {
+					return err
+				}
+				var err error
+				names, err = confirmRemove(stateDir, sel, yes, os.Stdin, cmd.OutOrStdout(), cmd.OutOrStderr())
+				if err != nil || len(names) == 0 {
+					return err
+				}
+			}
+
+			if err := runRemove(ctx, names, stateDir, opts, cmd.OutOrStdout(), cmd.OutOrStderr()); err != nil {
+				// Clusters which were not found have nothing left to force.
+				if !opts.Force && removeFailed(err) {
+					io.WriteString(cmd.OutOrStderr(), "Error while attempting remove.\nYou can verify the state details and try again, or use `--force` to remove all local state\n")
 				}
 				return err
 			}
@@ -53,53 +79,218 @@ func Remove(ctx context.Context, stateDir string, cfg *UserConfig) *cobra.Comman
 		},
 	}
 	flags := cmd.Flags()
-	flags.StringVarP(&subscriptionID, "subscription", "s", "", "Set the subscription to use to deploy with")
-	flags.BoolVarP(&force, "force", "f", false, "Force the removal of local state even if an error occurs when trying to remove from Azure")
+	flags.StringVarP(&subscriptionID, "subscription", "s", "", "Set the subscription to use for clusters which do not have one recorded in their state")
+	flags.BoolVarP(&opts.Force, "force", "f", false, "Force the removal of local state even if an error occurs when trying to remove from Azure")
+	flags.BoolVar(&all, "all", false, "Remove all clusters, or all clusters matching --filter and --older-than")
+	flags.BoolVarP(&yes, "yes", "y", false, "Do not ask for confirmation before removing the selected clusters")
+	flags.BoolVar(&opts.NoWait, "no-wait", false, "Return once deleting the resource groups has started, the local state is cleaned up by a later ls, wait --for removed or gc")
+	flags.IntVar(&opts.Parallel, "parallel", defaultRemoveParallel, "Maximum number of clusters to remove at the same time")
+	sel.addFlags(flags)
 	return cmd
 }
 
-func runRemove(ctx context.Context, names []string, stateDir, subscriptionID string, force bool, out io.Writer) error {
-	auth, err := getAuthorizer()
+var confirmRemoveHeader = []byte("NAME\tSTATUS\tLOCATION\tAGE\n")
+
+// confirmRemove lists the clusters matched by the selector and asks the user to confirm they should be removed.
+// The names of the clusters to remove are returned, which is empty if nothing matched.
+func confirmRemove(stateDir string, sel clusterSelector, yes bool, in io.Reader, outW, errW io.Writer) ([]string, error) {
+	now := time.Now()
+	selected, err := selectClusters(stateDir, sel, now)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if len(selected) == 0 {
+		io.WriteString(errW, "No clusters selected\n")
+		return nil, nil
 	}
 
-	gClient := resources.NewGroupsClient(subscriptionID)
-	gClient.Authorizer = auth
+	tw := tabwriter.NewWriter(outW, 20, 1, 3, ' ', tabwriter.TabIndent)
+	if _, err := tw.Write(confirmRemoveHeader); err != nil {
+		return nil, errors.Wrap(err, "error writing table header")
+	}
+	names := make([]string, 0, len(selected))
+	for _, c := range selected {
+		var age string
+		if !c.state.CreatedAt.IsZero() {
+			age = formatAge(now.Sub(c.state.CreatedAt))
+		}
+		io.WriteString(tw, c.name+"\t"+strings.Title(string(c.state.Status))+"\t"+c.state.Location+"\t"+age+"\n")
+		names = append(names, c.name)
+	}
+	if err := tw.Flush(); err != nil {
+		return nil, errors.Wrap(err, "error flushing table writer")
+	}
+
+	if yes {
+		return names, nil
+	}
+	what := "this cluster"
+	if len(names) > 1 {
+		what = fmt.Sprintf("these %d clusters", len(names))
+	}
+	fmt.Fprintf(errW, "Remove %s and everything in their resource groups? [y/N] ", what)
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return names, nil
+	}
+	return nil, errors.New("not removing any clusters")
+}
+
+// defaultRemoveParallel is how many clusters are removed at the same time by default.
+// Removing many more than this at once tends to get requests throttled by Azure.
+const defaultRemoveParallel = 5
+
+// removeOpts are the options for removing clusters.
+type removeOpts struct {
+	// Force removes the local state even if removing the cluster from Azure fails.
+	Force bool
+	// Parallel is the maximum number of clusters to remove at the same time.
+	Parallel int
+	// NoWait returns once deleting the resource group has started, see checkRemoved.
+	NoWait bool
+	// FallbackSubscription gets the subscription to use for clusters which do not have one in their state.
+	FallbackSubscription func() (string, error)
+}
 
-	errors := make(chan error, len(names))
+// Values for the result column of the `rm` summary
+const (
+	removeResultRemoved  = "removed"
+	removeResultStarted  = "started"
+	removeResultNotFound = "not found"
+	removeResultFailed   = "failed"
+)
+
+var removeSummaryHeader = []byte("NAME\tRESULT\tREASON\n")
+
+// removeError is returned by runRemove when some of the clusters could not be removed.
+type removeError struct {
+	Failed   int
+	NotFound int
+	Total    int
+}
+
+func (e removeError) Error() string {
+	if e.Failed == 0 {
+		return fmt.Sprintf("%d of %d clusters not found", e.NotFound, e.Total)
+	}
+	return fmt.Sprintf("failed to remove %d of %d clusters", e.Failed+e.NotFound, e.Total)
+}
+
+// removeFailed returns true if the error is from runRemove failing to remove a cluster which exists.
+func removeFailed(err error) bool {
+	e, ok := errors.Cause(err).(removeError)
+	return ok && e.Failed > 0
+}
+
+// runRemove removes the clusters, up to opts.Parallel at a time, and writes a summary of the results to outW.
+// Progress for each cluster is written to errW as it happens, along with the errors.
+// A removeError is returned if any of the clusters could not be removed, which is a not found error if none of them exist.
+func runRemove(ctx context.Context, names []string, stateDir string, opts removeOpts, outW, errW io.Writer) error {
+	parallel := opts.Parallel
+	if parallel < 1 {
+		parallel = defaultRemoveParallel
+	}
+	// Progress lines from different clusters must not be interleaved.
+	progressW := &syncWriter{w: errW}
+
+	errs := make([]error, len(names))
+	started := make([]bool, len(names))
+	sem := make(chan struct{}, parallel)
 	var wg sync.WaitGroup
 	wg.Add(len(names))
 
-	for _, name := range names {
-		go func(name string) {
-			errors <- removeCluster(ctx, name, stateDir, gClient, force)
-			wg.Done()
-		}(name)
+	for i, name := range names {
+		go func(i int, name string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			start := time.Now()
+			started[i], errs[i] = removeCluster(ctx, name, stateDir, opts, progressW)
+			elapsed := time.Since(start).Round(time.Second)
+			switch {
+			case started[i]:
+				fmt.Fprintf(progressW, "%s: deletion started after %s\n", name, elapsed)
+			case errs[i] == nil:
+				fmt.Fprintf(progressW, "%s: removed after %s\n", name, elapsed)
+			case !strongerrors.IsNotFound(errs[i]):
+				fmt.Fprintf(progressW, "%s: failed after %s\n", name, elapsed)
+			}
+		}(i, name)
 	}
 	wg.Wait()
-	close(errors)
-	for err := range errors {
-		if err != nil {
-			io.WriteString(out, err.Error()+"\n")
+
+	tw := tabwriter.NewWriter(outW, 20, 1, 3, ' ', tabwriter.TabIndent)
+	if _, err := tw.Write(removeSummaryHeader); err != nil {
+		return errors.Wrap(err, "error writing table header")
+	}
+	var failed, notFound, pending int
+	for i, name := range names {
+		result, reason := removeResultRemoved, ""
+		if started[i] {
+			result = removeResultStarted
+			pending++
 		}
+		if err := errs[i]; err != nil {
+			io.WriteString(errW, "Error removing "+name+": "+err.Error()+"\n")
+			result = removeResultFailed
+			if strongerrors.IsNotFound(err) {
+				result = removeResultNotFound
+				notFound++
+			} else {
+				failed++
+			}
+			reason = strings.SplitN(err.Error(), "\n", 2)[0]
+			if len(reason) > maxMessageLen {
+				reason = reason[:maxMessageLen-3] + "..."
+			}
+		}
+		io.WriteString(tw, name+"\t"+result+"\t"+reason+"\n")
+	}
+	if err := tw.Flush(); err != nil {
+		return errors.Wrap(err, "error flushing table writer")
+	}
+	if pending > 0 {
+		io.WriteString(errW, "Resource groups are still being deleted, use `testrig ls` or `testrig wait --for removed <name>` to check on them\n")
+	}
+
+	err := removeError{Failed: failed, NotFound: notFound, Total: len(names)}
+	switch {
+	case notFound == len(names):
+		return strongerrors.NotFound(err)
+	case failed+notFound > 0:
+		return err
 	}
 	return nil
 }
 
-func removeCluster(ctx context.Context, name, stateDir string, client resources.GroupsClient, force bool) (retErr error) {
+// syncWriter makes writes from multiple goroutines safe, each write is written out whole.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (w *syncWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
+
+// removeCluster removes a cluster from Azure and its local state, reporting progress to errW.
+// With opts.NoWait it returns as soon as deleting the resource group has started, with started set.
+// The deletion is saved in the state so it can be checked on later, see checkRemoved.
+// A cluster left being removed by an earlier `rm --no-wait` is waited on rather than deleted again.
+func removeCluster(ctx context.Context, name, stateDir string, opts removeOpts, errW io.Writer) (started bool, retErr error) {
 	dir := filepath.Join(stateDir, name)
+	var s state
 
 	defer func() {
-		if retErr == nil || force {
-			removing := dir + ".removing"
-			if err := os.Rename(dir, removing); err != nil && !os.IsNotExist(err) {
-				if retErr == nil {
-					retErr = err
-				}
-				return
-			}
-			if err := os.RemoveAll(removing); err != nil && !os.IsNotExist(err) {
+		if started {
+			return
+		}
+		if retErr == nil || opts.Force {
+			if err := removeLocalCluster(name, dir, s); err != nil {
 				if retErr == nil {
 					retErr = err
 				}
@@ -110,42 +301,129 @@ func removeCluster(ctx context.Context, name, stateDir string, client resources.
 	}()
 
 	if _, err := os.Stat(dir); os.IsNotExist(err) {
-		return clusterNotFound(name)
+		return false, clusterNotFound(name)
 	}
 
-	s, err := readState(dir)
+	var err error
+	s, err = readState(dir)
 	if err != nil {
-		return err
+		return false, err
+	}
+	resuming := s.Status == stateRemoving && s.DeleteOperation != nil
+	if !resuming && (s.Status == stateInitialized || s.Status == stateCreating || s.Status == stateRemoving) {
+		return false, errors.Errorf("cannot remove while status is in state %q", strings.Title(string(s.Status)))
 	}
-	if s.Status == stateInitialized || s.Status == stateCreating || s.Status == stateRemoving {
-		return errors.Errorf("cannot remove while status is in state %q", strings.Title(string(s.Status)))
+	if resuming && opts.NoWait {
+		return false, errors.New("cluster is already being removed")
 	}
 	s.Status = stateRemoving
 	defer func() {
 		if retErr != nil {
 			s.Status = stateDead
+			s.FailureMessage = "error removing cluster: " + retErr.Error()
+			s.FailureDetails = nil
+			s.DeleteOperation = nil
 			writeState(dir, s)
 		}
 	}()
 	writeState(dir, s)
 
 	if s.ResourceGroup == "" {
-		return errors.New("missing resource group in state object, cannot remove")
+		return false, errors.New("missing resource group in state object, cannot remove")
 	}
 
-	future, err := client.Delete(ctx, s.ResourceGroup)
-	if err != nil {
-		if isAzureNotFound(err) {
-			err = nil
-		}
+	if _, err := clusterSubscription(dir, &s, opts.FallbackSubscription); err != nil {
+		return false, err
+	}
+	c := &cluster{name: name, dir: dir, state: &s, errW: errW}
+
+	var future groupDeleteFuture
+	if resuming {
+		client, err := newBackend().groups(s)
 		if err != nil {
-			return errors.Wrapf(err, "error starting resource group deletion for %q", s.ResourceGroup)
+			return false, err
+		}
+		if future, err = client.ResumeDelete(s.DeleteOperation); err != nil {
+			return false, err
 		}
 	} else {
-		if err := future.WaitForCompletionRef(ctx, client.Client); err != nil {
-			return errors.Wrapf(err, "error waiting for resource group deletion to finish for %q", s.ResourceGroup)
+		// Removing does not need the engine binaries.
+		p, err := newProvisioner(s.Provisioner, enginePaths{})
+		if err != nil {
+			return false, err
+		}
+		future, err = p.delete(ctx, c)
+		if err != nil || future == nil {
+			return false, err
+		}
+	}
+
+	if opts.NoWait {
+		saved, err := json.Marshal(future)
+		if err != nil {
+			return false, errors.Wrap(err, "error saving resource group deletion")
+		}
+		s.DeleteOperation = saved
+		if err := writeState(dir, s); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	return false, waitDeleted(ctx, c, future)
+}
+
+// resumeRemovals checks on the clusters left being removed by `rm --no-wait`, see checkRemoved.
+// Progress and errors are written to errW rather than returned so they do not get in the way of the command
+// doing this on the side.
+func resumeRemovals(ctx context.Context, stateDir string, errW io.Writer) {
+	names, err := listClusters(stateDir)
+	if err != nil {
+		return
+	}
+
+	backend := newBackend()
+	for _, name := range names {
+		dir := filepath.Join(stateDir, name)
+		s, err := readState(dir)
+		if err != nil || s.Status != stateRemoving || s.DeleteOperation == nil {
+			continue
+		}
+
+		client, err := backend.groups(s)
+		if err == nil {
+			var removed bool
+			removed, err = checkRemoved(ctx, dir, client)
+			if removed {
+				io.WriteString(errW, name+": removed\n")
+			}
+		}
+		if err != nil {
+			io.WriteString(errW, "Error removing "+name+": "+err.Error()+"\n")
 		}
 	}
+}
+
+// removeLocalCluster removes the local state of a cluster and its entries in the user's kubeconfig.
+func removeLocalCluster(name, dir string, s state) error {
+	var err error
+	if s.MergedKubeConfig != "" {
+		err = errors.Wrap(unmergeKubeConfig(name, s.MergedKubeConfig), "error removing cluster from kubeconfig")
+	}
+	if rmErr := removeLocalState(dir); rmErr != nil {
+		return rmErr
+	}
+	return err
+}
 
+// removeLocalState removes the state dir for a cluster.
+// The dir is renamed first so a partially removed cluster is not picked up by other commands.
+func removeLocalState(dir string) error {
+	removing := dir + ".removing"
+	if err := os.Rename(dir, removing); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.RemoveAll(removing); err != nil && !os.IsNotExist(err) {
+		return err
+	}
 	return nil
 }
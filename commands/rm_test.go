@@ -0,0 +1,241 @@
+package commands
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cpuguy83/strongerrors"
+)
+
+func (e *testEnv) remove(names ...string) error {
+	opts := removeOpts{Parallel: defaultRemoveParallel, FallbackSubscription: func() (string, error) { return "sub", nil }}
+	return runRemove(context.Background(), names, e.stateDir, opts, ioutil.Discard, ioutil.Discard)
+}
+
+func (e *testEnv) clusterExists(name string) bool {
+	_, err := os.Stat(filepath.Join(e.stateDir, name))
+	return err == nil
+}
+
+func TestRemove(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.cleanup()
+
+	a, b := e.create("a"), e.create("b")
+	if err := e.remove("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	for name, s := range map[string]state{"a": a, "b": b} {
+		if e.clusterExists(name) {
+			t.Errorf("expected local state for %s to be removed", name)
+		}
+		if e.groupExists(s.ResourceGroup) {
+			t.Errorf("expected resource group for %s to be removed", name)
+		}
+	}
+}
+
+func TestRemoveFailure(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.cleanup()
+
+	s := e.create("test")
+	e.fail("delete-group")
+	if err := e.remove("test", "missing"); !removeFailed(err) {
+		t.Fatalf("expected a failed removal, got: %v", err)
+	}
+	if got := e.state("test").Status; got != stateDead {
+		t.Fatalf("expected status %q, got %q", stateDead, got)
+	}
+	if !e.groupExists(s.ResourceGroup) {
+		t.Fatal("resource group should still exist")
+	}
+
+	// Once Azure cooperates the cluster can be removed.
+	e.fail("")
+	if err := e.remove("test"); err != nil {
+		t.Fatal(err)
+	}
+	if e.clusterExists("test") {
+		t.Fatal("expected local state to be removed")
+	}
+}
+
+func TestRemoveNotFound(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.cleanup()
+
+	err := e.remove("missing")
+	if !strongerrors.IsNotFound(err) {
+		t.Fatalf("expected not found error, got: %v", err)
+	}
+}
+
+func TestRemoveSomeNotFound(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.cleanup()
+
+	e.create("test")
+	err := e.remove("test", "missing")
+	if err == nil || strongerrors.IsNotFound(err) {
+		t.Fatalf("expected a failure when only some clusters are found, got: %v", err)
+	}
+	if removeFailed(err) {
+		t.Fatal("clusters which were not found should not count as failed removals")
+	}
+	if e.clusterExists("test") {
+		t.Fatal("the cluster which was found should still be removed")
+	}
+}
+
+func TestRemoveGroupNotFound(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.cleanup()
+
+	// A resource group which was already deleted out from under testrig is not an error.
+	s := e.create("test")
+	if err := os.Remove(filepath.Join(FakeAzure, "sub", s.ResourceGroup+".json")); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.remove("test"); err != nil {
+		t.Fatal(err)
+	}
+	if e.clusterExists("test") {
+		t.Fatal("expected local state to be removed")
+	}
+}
+
+func TestCheckRemoved(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.cleanup()
+
+	s := e.create("test")
+	dir := filepath.Join(e.stateDir, "test")
+	if done, err := checkRemoved(context.Background(), dir, e.groups()); err != nil || done {
+		t.Fatalf("a ready cluster is not removed, got done=%v err=%v", done, err)
+	}
+
+	// Start deleting the group, as if `rm` was interrupted while waiting for it.
+	if _, err := e.groups().Delete(context.Background(), s.ResourceGroup); err != nil {
+		t.Fatal(err)
+	}
+	s.Status = stateRemoving
+	if err := writeState(dir, s); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(fakeDeployTime())
+
+	if e.groupExists(s.ResourceGroup) {
+		t.Fatal("resource group should be gone once its deletion has finished")
+	}
+	done, err := checkRemoved(context.Background(), dir, e.groups())
+	if err != nil || !done {
+		t.Fatalf("expected cluster to be removed, got done=%v err=%v", done, err)
+	}
+	if e.clusterExists("test") {
+		t.Fatal("expected local state to be removed")
+	}
+
+	// Already removed.
+	if done, err := checkRemoved(context.Background(), dir, e.groups()); err != nil || !done {
+		t.Fatalf("expected missing cluster to count as removed, got done=%v err=%v", done, err)
+	}
+}
+
+func TestRemoveNoWait(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.cleanup()
+
+	s := e.create("test")
+	opts := removeOpts{Parallel: defaultRemoveParallel, NoWait: true}
+	if err := runRemove(context.Background(), []string{"test"}, e.stateDir, opts, ioutil.Discard, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	s = e.state("test")
+	if s.Status != stateRemoving || s.DeleteOperation == nil {
+		t.Fatalf("expected the cluster to be left removing with the deletion saved, got status %q", s.Status)
+	}
+
+	time.Sleep(fakeDeployTime())
+	resumeRemovals(context.Background(), e.stateDir, ioutil.Discard)
+	if e.clusterExists("test") {
+		t.Fatal("expected local state to be removed once the deletion finished")
+	}
+}
+
+func TestRemoveNoWaitFailure(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.cleanup()
+
+	s := e.create("test")
+	opts := removeOpts{Parallel: defaultRemoveParallel, NoWait: true}
+	if err := runRemove(context.Background(), []string{"test"}, e.stateDir, opts, ioutil.Discard, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	e.fail("delete-group-async")
+	dir := filepath.Join(e.stateDir, "test")
+	if _, err := checkRemoved(context.Background(), dir, e.groups()); err == nil {
+		t.Fatal("expected the failed deletion to be reported")
+	}
+	s = e.state("test")
+	if s.Status != stateDead || s.DeleteOperation != nil {
+		t.Fatalf("expected cluster to be dead with no pending deletion, got status %q", s.Status)
+	}
+
+	// `wait --for removed` keeps reporting the failure rather than waiting for the group to go away.
+	e.fail("")
+	time.Sleep(fakeDeployTime())
+	if !e.groupExists(s.ResourceGroup) {
+		t.Fatal("resource group should still exist after its deletion failed")
+	}
+	if _, err := checkRemoved(context.Background(), dir, e.groups()); err == nil {
+		t.Fatal("expected an error for a dead cluster whose resource group still exists")
+	}
+}
+
+func TestRemoveNotReady(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.cleanup()
+	e.fail("kubernetes")
+
+	// Clusters whose Kubernetes never became ready are left provisioned, but can still be cleaned up.
+	opts := e.createOpts()
+	opts.ReadyTimeout = 100 * time.Millisecond
+	for _, name := range []string{"rm", "gc"} {
+		if err := runCreate(context.Background(), name, opts, nil, ioutil.Discard, ioutil.Discard); err == nil {
+			t.Fatalf("expected error creating %s", name)
+		}
+		if got := e.state(name).Status; got != stateProvisioned {
+			t.Fatalf("expected status %q, got %q", stateProvisioned, got)
+		}
+	}
+
+	if err := e.remove("rm"); err != nil {
+		t.Fatal(err)
+	}
+	if e.clusterExists("rm") {
+		t.Fatal("expected local state to be removed")
+	}
+
+	s := e.state("gc")
+	expiresAt := time.Now().Add(-time.Minute)
+	s.ExpiresAt = &expiresAt
+	if err := writeState(filepath.Join(e.stateDir, "gc"), s); err != nil {
+		t.Fatal(err)
+	}
+	noSubscription := func() (string, error) { return "", nil }
+	if err := runGC(context.Background(), e.stateDir, noSubscription, false, ioutil.Discard, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if e.clusterExists("gc") {
+		t.Fatal("expected expired cluster to be removed")
+	}
+	if e.groupExists(s.ResourceGroup) {
+		t.Fatal("expected resource group to be removed")
+	}
+}
@@ -0,0 +1,94 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// ExitStatusError is returned when a program run by testrig exits with a non-zero status.
+// testrig should exit with the same status, without printing anything since the program has already reported its error.
+type ExitStatusError struct {
+	Status int
+}
+
+func (e ExitStatusError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Status)
+}
+
+// Run creates the `run` subcommand which runs a program with the environment for a cluster.
+func Run(ctx context.Context, stateDir string) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "run",
+		Example: "run <name> -- kubectl get nodes",
+		Short:   "Run a command with KUBECONFIG and the other variables from \"testrig env\" set for a cluster",
+		Args:    cobra.MinimumNArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name, args := args[0], args[1:]
+			if args[0] == "--" {
+				args = args[1:]
+			}
+			if len(args) == 0 {
+				return errors.New("must specify a command to run")
+			}
+			return runRun(ctx, name, stateDir, args, os.Stdin, cmd.OutOrStdout(), cmd.OutOrStderr())
+		},
+	}
+	// Everything after the cluster name belongs to the program being run.
+	cmd.Flags().SetInterspersed(false)
+	return cmd
+}
+
+func runRun(ctx context.Context, name, stateDir string, args []string, in io.Reader, outW, errW io.Writer) error {
+	values, err := clusterEnv(ctx, name, stateDir)
+	if err != nil {
+		return err
+	}
+
+	path, err := exec.LookPath(args[0])
+	if err != nil {
+		return errors.Wrapf(err, "error looking up %s", args[0])
+	}
+
+	// Not using exec.CommandContext since that kills the program outright, it is asked to stop once ctx is cancelled instead.
+	cmd := exec.Command(path, args[1:]...)
+	cmd.Stdin = in
+	cmd.Stdout = outW
+	cmd.Stderr = errW
+	cmd.Env = os.Environ()
+	for _, v := range envVars {
+		cmd.Env = append(cmd.Env, v+"="+values[v])
+	}
+
+	if err := cmd.Start(); err != nil {
+		return errors.Wrapf(err, "error starting %s", args[0])
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			cmd.Process.Signal(syscall.SIGTERM)
+		case <-done:
+		}
+	}()
+
+	err = cmd.Wait()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			if status.Signaled() {
+				// Same as shells, 128 + the signal number.
+				return ExitStatusError{Status: 128 + int(status.Signal())}
+			}
+			return ExitStatusError{Status: status.ExitStatus()}
+		}
+	}
+	return errors.Wrapf(err, "error running %s", args[0])
+}
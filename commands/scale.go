@@ -0,0 +1,51 @@
+package commands
+
+import (
+	"context"
+	"io"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// Scale creates a command to change the number of nodes in an agent pool of a cluster.
+func Scale(ctx context.Context, stateDir string) *cobra.Command {
+	var (
+		pool    string
+		count   int
+		engines enginePaths
+	)
+
+	cmd := &cobra.Command{
+		Use:   "scale <name>",
+		Short: "Change the number of nodes in an agent pool",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !cmd.Flags().Changed("count") {
+				return errors.New("--count is required")
+			}
+			if count < 1 {
+				return errors.New("--count must be at least 1")
+			}
+			return runScale(ctx, args[0], stateDir, engines, pool, count, cmd.OutOrStderr())
+		},
+	}
+
+	flags := cmd.Flags()
+	flags.StringVar(&pool, "pool", defaultLinuxPool, "Name of the agent pool to scale")
+	flags.IntVar(&count, "count", 0, "Number of nodes the agent pool should have")
+	engines.addFlags(flags)
+	return cmd
+}
+
+func runScale(ctx context.Context, name, stateDir string, engines enginePaths, pool string, count int, errW io.Writer) error {
+	c, err := loadReadyCluster(stateDir, name, errW)
+	if err != nil {
+		return err
+	}
+	p, err := newProvisioner(c.state.Provisioner, engines)
+	if err != nil {
+		return err
+	}
+	return p.scale(ctx, c, pool, count)
+}
@@ -0,0 +1,131 @@
+package commands
+
+import (
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+)
+
+// clusterFilters gets the value of each key which can be used with `--filter` from a cluster's state.
+var clusterFilters = map[string]func(s state) string{
+	"status":       func(s state) string { return string(s.Status) },
+	"location":     func(s state) string { return s.Location },
+	"provisioner":  func(s state) string { return s.Provisioner },
+	"subscription": func(s state) string { return s.SubscriptionID },
+	"created-by":   func(s state) string { return s.CreatedBy },
+}
+
+// clusterSelector selects clusters by name and the properties in their state, as used by `ls` and `rm`.
+type clusterSelector struct {
+	// Patterns are globs matched against the cluster name, a cluster has to match one of them.
+	Patterns []string
+	// Filters are key=value pairs, see clusterFilters.
+	// Filters with the same key match if any of them match, otherwise they all have to match.
+	Filters   []string
+	OlderThan time.Duration
+}
+
+func (sel *clusterSelector) addFlags(flags *pflag.FlagSet) {
+	flags.StringArrayVar(&sel.Filters, "filter", nil, "Only select clusters matching a filter, e.g. status=failed or location=eastus, the value can be a glob (can be repeated)")
+	flags.DurationVar(&sel.OlderThan, "older-than", 0, "Only select clusters created longer ago than this, e.g. 24h")
+}
+
+// empty is true if nothing has been set to select clusters by.
+func (sel clusterSelector) empty() bool {
+	return len(sel.Patterns) == 0 && len(sel.Filters) == 0 && sel.OlderThan == 0
+}
+
+func (sel clusterSelector) validate() error {
+	for _, p := range sel.Patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return errors.Errorf("invalid name pattern %q", p)
+		}
+	}
+	for _, f := range sel.Filters {
+		parts := strings.SplitN(f, "=", 2)
+		if len(parts) != 2 {
+			return errors.Errorf("invalid filter %q, must be in the form key=value", f)
+		}
+		if _, ok := clusterFilters[parts[0]]; !ok {
+			keys := make([]string, 0, len(clusterFilters))
+			for k := range clusterFilters {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			return errors.Errorf("invalid filter %q, key must be one of: %s", f, strings.Join(keys, ", "))
+		}
+		if _, err := path.Match(parts[1], ""); err != nil {
+			return errors.Errorf("invalid filter %q, bad pattern", f)
+		}
+	}
+	return nil
+}
+
+// matches checks if a cluster is selected.
+// Clusters without a creation time are never older than anything.
+func (sel clusterSelector) matches(name string, s state, now time.Time) bool {
+	if len(sel.Patterns) > 0 && !matchAny(sel.Patterns, name) {
+		return false
+	}
+
+	byKey := make(map[string][]string)
+	for _, f := range sel.Filters {
+		parts := strings.SplitN(f, "=", 2)
+		byKey[parts[0]] = append(byKey[parts[0]], parts[1])
+	}
+	for k, patterns := range byKey {
+		if !matchAny(patterns, clusterFilters[k](s)) {
+			return false
+		}
+	}
+
+	if sel.OlderThan > 0 && (s.CreatedAt.IsZero() || now.Sub(s.CreatedAt) < sel.OlderThan) {
+		return false
+	}
+	return true
+}
+
+// matchAny checks if the value matches any of the globs, ignoring case.
+func matchAny(patterns []string, v string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(strings.ToLower(p), strings.ToLower(v)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// isPattern is true if the name has any glob characters in it.
+func isPattern(name string) bool {
+	return strings.ContainsAny(name, "*?[")
+}
+
+// selectClusters gets the local clusters matched by the selector, sorted by name.
+// Clusters whose state cannot be read are only selected when the selector only has name patterns.
+func selectClusters(stateDir string, sel clusterSelector, now time.Time) ([]clusterState, error) {
+	names, err := listClusters(stateDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var selected []clusterState
+	for _, name := range names {
+		s, err := readState(filepath.Join(stateDir, name))
+		if err != nil && (len(sel.Filters) > 0 || sel.OlderThan > 0) {
+			continue
+		}
+		if sel.matches(name, s, now) {
+			selected = append(selected, clusterState{name: name, state: s})
+		}
+	}
+
+	sort.Slice(selected, func(i, j int) bool {
+		return selected[i].name < selected[j].name
+	})
+	return selected, nil
+}
@@ -46,6 +46,9 @@ func runSSH(ctx context.Context, name string, stateDir string, sshArgs []string,
 		}
 		return err
 	}
+	if s.Provisioner == provisionerAKS {
+		return errors.New("ssh is not supported for clusters provisioned with aks, the leader nodes are managed by AKS")
+	}
 
 	identifyFile := s.SSHIdentityFile
 	if identifyFile == "" {
@@ -5,8 +5,10 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
+	"github.com/Azure/go-autorest/autorest/azure"
 	"github.com/cpuguy83/strongerrors"
 
 	"github.com/pkg/errors"
@@ -17,6 +19,8 @@ type status string
 var (
 	stateInitialized status = "initialized"
 	stateCreating    status = "creating"
+	// stateProvisioned is set once the cluster is deployed to Azure, while waiting for Kubernetes to be ready
+	stateProvisioned status = "provisioned"
 	stateReady       status = "ready"
 	stateFailure     status = "failed"
 	stateRemoving    status = "removing"
@@ -24,14 +28,107 @@ var (
 )
 
 type state struct {
-	Location        string
-	ResourceGroup   string
-	DNSPrefix       string
-	Status          status
+	SubscriptionID string
+	Cloud          string
+	// CloudEnvironment is only set for custom clouds, see lookupCloud
+	CloudEnvironment *azure.Environment `json:",omitempty"`
+	Location         string
+	ResourceGroup    string
+	DNSPrefix        string
+	Status           status
+	// Provisioner is the name of the provisioner the cluster was created with, see newProvisioner
+	Provisioner string `json:",omitempty"`
+	// FQDN is only set when it cannot be derived from the DNS prefix, see makeFQDN
+	FQDN            string `json:",omitempty"`
 	FailureMessage  string
+	FailureDetails  []failureDetail `json:",omitempty"`
 	SSHIdentityFile string
 	DeploymentName  string
 	CreatedAt       time.Time
+	CreatedBy       string
+	ExpiresAt       *time.Time        `json:",omitempty"`
+	Tags            map[string]string `json:",omitempty"`
+	// MergedKubeConfig is the user kubeconfig the cluster's credentials were merged into, see mergeKubeConfig
+	MergedKubeConfig string `json:",omitempty"`
+	// DeleteOperation is the deletion of the resource group started by `rm --no-wait`, as saved by groupDeleteFuture.
+	// It includes the URL to poll for the status of the deletion.
+	DeleteOperation json.RawMessage `json:",omitempty"`
+}
+
+// failureDetail is the error reported by Azure for a single failed deployment operation.
+type failureDetail struct {
+	Resource string
+	Code     string
+	Message  string
+}
+
+func (f failureDetail) String() string {
+	if f.Code == "" {
+		return f.Resource + ": " + f.Message
+	}
+	return f.Resource + ": " + f.Code + ": " + f.Message
+}
+
+// failureReason summarizes the failure details as the list of distinct error codes.
+func (s state) failureReason() string {
+	var codes []string
+	seen := make(map[string]bool)
+	for _, f := range s.FailureDetails {
+		if f.Code == "" || seen[f.Code] {
+			continue
+		}
+		seen[f.Code] = true
+		codes = append(codes, f.Code)
+	}
+	return strings.Join(codes, ", ")
+}
+
+// clusterSubscription gets the subscription the cluster was deployed to.
+// State written by older versions of testrig does not have the subscription, in which case the subscription from
+// the fallback is recorded in the state so the cluster stays pinned to it from then on.
+func clusterSubscription(dir string, s *state, fallback func() (string, error)) (string, error) {
+	if s.SubscriptionID != "" {
+		return s.SubscriptionID, nil
+	}
+
+	subscriptionID, err := fallback()
+	if err != nil {
+		return "", errors.Wrap(err, "subscription is not recorded in the cluster state")
+	}
+	s.SubscriptionID = subscriptionID
+	if s.Cloud == "" {
+		// Older versions of testrig always deployed to the public cloud, whichever cloud the az CLI is using now.
+		s.Cloud = defaultAzCloud
+	}
+	if err := writeState(dir, *s); err != nil {
+		return "", err
+	}
+	return subscriptionID, nil
+}
+
+// expired returns true if the cluster has a TTL which has passed.
+func (s state) expired(now time.Time) bool {
+	return s.ExpiresAt != nil && now.After(*s.ExpiresAt)
+}
+
+// listClusters gets the names of all the clusters in the state dir.
+func listClusters(stateDir string) ([]string, error) {
+	ls, err := ioutil.ReadDir(stateDir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading state dir %q", stateDir)
+	}
+
+	var names []string
+	for _, e := range ls {
+		if !e.IsDir() {
+			continue
+		}
+		if strings.HasSuffix(e.Name(), ".removing") {
+			continue
+		}
+		names = append(names, e.Name())
+	}
+	return names, nil
 }
 
 func writeState(dir string, s state) error {
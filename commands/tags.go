@@ -0,0 +1,71 @@
+package commands
+
+import (
+	"os"
+	"os/user"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Version is the version of testrig.
+// This is set at build time.
+var Version = "dev"
+
+// Tags set on the resource groups created by testrig.
+// These make it possible to attribute spend and to find the clusters created by testrig in a subscription.
+const (
+	tagCluster   = "testrig-cluster"
+	tagCreatedBy = "testrig-created-by"
+	tagCreatedAt = "testrig-created-at"
+	tagExpiresAt = "testrig-expires-at"
+	tagVersion   = "testrig-version"
+)
+
+// groupTags gets the tags to set on the resource group for a cluster.
+// User defined tags are included, but cannot override the tags set by testrig.
+func groupTags(name string, s state) map[string]*string {
+	tags := make(map[string]*string, len(s.Tags)+5)
+	for k, v := range s.Tags {
+		tags[k] = stringPtr(v)
+	}
+
+	tags[tagCluster] = stringPtr(name)
+	tags[tagVersion] = stringPtr(Version)
+	tags[tagCreatedAt] = stringPtr(s.CreatedAt.UTC().Format(time.RFC3339))
+	if s.CreatedBy != "" {
+		tags[tagCreatedBy] = stringPtr(s.CreatedBy)
+	}
+	if s.ExpiresAt != nil {
+		tags[tagExpiresAt] = stringPtr(s.ExpiresAt.UTC().Format(time.RFC3339))
+	}
+	return tags
+}
+
+// validateTags checks that user supplied tags are allowed by Azure and don't collide with the tags set by testrig.
+func validateTags(tags map[string]string) error {
+	for k := range tags {
+		if k == "" {
+			return errors.New("tag name must not be empty")
+		}
+		if strings.ContainsAny(k, `<>%&\?/`) {
+			return errors.Errorf("invalid tag name %q: must not contain any of <>%%&\\?/", k)
+		}
+		if strings.HasPrefix(strings.ToLower(k), "testrig-") {
+			return errors.Errorf("invalid tag name %q: the testrig- prefix is reserved", k)
+		}
+	}
+	return nil
+}
+
+// currentUser gets the name of the user running testrig, for attributing clusters.
+func currentUser() string {
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		return u.Username
+	}
+	if name := os.Getenv("USER"); name != "" {
+		return name
+	}
+	return os.Getenv("USERNAME")
+}
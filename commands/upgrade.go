@@ -0,0 +1,37 @@
+package commands
+
+import (
+	"context"
+	"io"
+
+	"github.com/spf13/cobra"
+)
+
+// Upgrade creates a command to upgrade a cluster to a different Kubernetes version.
+func Upgrade(ctx context.Context, stateDir string) *cobra.Command {
+	var engines enginePaths
+
+	cmd := &cobra.Command{
+		Use:   "upgrade <name> <kubernetes version>",
+		Short: "Upgrade a cluster to a different Kubernetes version",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runUpgrade(ctx, args[0], stateDir, engines, args[1], cmd.OutOrStderr())
+		},
+	}
+
+	engines.addFlags(cmd.Flags())
+	return cmd
+}
+
+func runUpgrade(ctx context.Context, name, stateDir string, engines enginePaths, version string, errW io.Writer) error {
+	c, err := loadReadyCluster(stateDir, name, errW)
+	if err != nil {
+		return err
+	}
+	p, err := newProvisioner(c.state.Provisioner, engines)
+	if err != nil {
+		return err
+	}
+	return p.upgrade(ctx, c, version)
+}
@@ -0,0 +1,290 @@
+package commands
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+type waitCondition string
+
+const (
+	waitReady   waitCondition = "ready"
+	waitRemoved waitCondition = "removed"
+)
+
+// pollInterval is how often Azure is checked while waiting on a cluster.
+var pollInterval = 15 * time.Second
+
+// Wait creates the `wait` subcommand which blocks until a cluster is ready or removed.
+// This is mostly useful along with `create --detach`.
+func Wait(ctx context.Context, stateDir string, cfg *UserConfig) *cobra.Command {
+	var (
+		condition      string
+		timeout        time.Duration
+		subscriptionID string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "wait",
+		Short: "Wait for a cluster to be ready or removed",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cond := waitCondition(strings.ToLower(condition))
+			if cond != waitReady && cond != waitRemoved {
+				return errors.Errorf("invalid value for --for: %q, must be one of: %s, %s", condition, waitReady, waitRemoved)
+			}
+
+			fallbackSubscription := func() (string, error) {
+				return resolveSubscription(subscriptionID, cfg)
+			}
+
+			if timeout > 0 {
+				var cancel func()
+				ctx, cancel = context.WithTimeout(ctx, timeout)
+				defer cancel()
+			}
+
+			return runWait(ctx, args[0], stateDir, fallbackSubscription, cond)
+		},
+	}
+
+	flags := cmd.Flags()
+	flags.StringVar(&condition, "for", string(waitReady), "Condition to wait for, one of: ready, removed")
+	flags.DurationVar(&timeout, "timeout", 0, "Maximum amount of time to wait, 0 waits forever")
+	flags.StringVarP(&subscriptionID, "subscription", "s", "", "Set the subscription to use if the cluster does not have one recorded in its state")
+	return cmd
+}
+
+func runWait(ctx context.Context, name, stateDir string, fallbackSubscription func() (string, error), cond waitCondition) error {
+	dir := filepath.Join(stateDir, name)
+	s, err := readState(dir)
+	if err != nil {
+		if _, statErr := os.Stat(dir); os.IsNotExist(statErr) {
+			if cond == waitRemoved {
+				return nil
+			}
+			return clusterNotFound(name)
+		}
+		return err
+	}
+
+	if _, err := clusterSubscription(dir, &s, fallbackSubscription); err != nil {
+		return err
+	}
+
+	backend := newBackend()
+	dClient, err := backend.deployments(s)
+	if err != nil {
+		return err
+	}
+	gClient, err := backend.groups(s)
+	if err != nil {
+		return err
+	}
+
+	for {
+		var done bool
+		switch cond {
+		case waitReady:
+			done, err = checkReady(ctx, dir, dClient)
+		case waitRemoved:
+			done, err = checkRemoved(ctx, dir, gClient)
+		}
+		if err != nil || done {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return errors.Errorf("timed out waiting for cluster %q to be %s", name, cond)
+			}
+			return ctx.Err()
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// checkReady checks if the cluster in dir has finished deploying and Kubernetes in it is ready.
+// If the cluster is still being created and the deployment has already been submitted, the deployment status
+// is fetched from Azure and the local state is updated to match.
+// For clusters provisioned with AKS the status of the managed cluster is used instead of the deployment.
+func checkReady(ctx context.Context, dir string, client deploymentsClient) (bool, error) {
+	s, err := readState(dir)
+	if err != nil {
+		return false, err
+	}
+
+	switch s.Status {
+	case stateReady:
+		return true, nil
+	case stateProvisioned:
+		return checkProvisioned(ctx, dir, s)
+	case stateInitialized:
+		return false, nil
+	case stateCreating:
+		if s.DeploymentName == "" {
+			// Still generating the deployment, nothing to check in Azure yet.
+			return false, nil
+		}
+	case stateFailure:
+		return false, deployFailedError(s)
+	default:
+		return false, errors.Errorf("cluster will not become ready, current state: %s", strings.Title(string(s.Status)))
+	}
+
+	var provisioningState string
+	if s.Provisioner == provisionerAKS {
+		mcClient, err := (&aksProvisioner{}).client(&cluster{state: &s})
+		if err != nil {
+			return false, err
+		}
+		mc, err := mcClient.Get(ctx, s.ResourceGroup, s.DeploymentName)
+		if err != nil {
+			if isAzureNotFound(err) {
+				return false, nil
+			}
+			return false, errors.Wrapf(err, "error getting status of managed cluster %q", s.DeploymentName)
+		}
+		if mc.ManagedClusterProperties == nil || mc.ProvisioningState == nil {
+			return false, nil
+		}
+		provisioningState = *mc.ProvisioningState
+		if mc.Fqdn != nil {
+			s.FQDN = *mc.Fqdn
+		}
+	} else {
+		deployment, err := client.Get(ctx, s.ResourceGroup, s.DeploymentName)
+		if err != nil {
+			if isAzureNotFound(err) {
+				return false, nil
+			}
+			return false, errors.Wrapf(err, "error getting status of deployment %q", s.DeploymentName)
+		}
+		if deployment.Properties == nil || deployment.Properties.ProvisioningState == nil {
+			return false, nil
+		}
+		provisioningState = *deployment.Properties.ProvisioningState
+	}
+
+	switch provisioningState {
+	case "Succeeded":
+		s.Status = stateProvisioned
+		if err := writeState(dir, s); err != nil {
+			return false, errors.Wrap(err, "deployment succeeded but received error while writing state")
+		}
+		return checkProvisioned(ctx, dir, s)
+	case "Failed", "Canceled":
+		s.Status = stateFailure
+		s.FailureMessage = "deployment " + strings.ToLower(provisioningState)
+		if s.Provisioner != provisionerAKS {
+			s.FailureDetails, _ = deploymentFailures(ctx, client, s.ResourceGroup, s.DeploymentName)
+		}
+		writeState(dir, s)
+		return false, deployFailedError(s)
+	}
+	return false, nil
+}
+
+// checkProvisioned checks if Kubernetes is ready in a cluster which has been deployed, marking the cluster as ready once it is.
+func checkProvisioned(ctx context.Context, dir string, s state) (bool, error) {
+	model, err := readAPIModel(dir)
+	if err != nil {
+		return false, err
+	}
+	p, err := newProvisioner(s.Provisioner, enginePaths{})
+	if err != nil {
+		return false, err
+	}
+
+	c := &cluster{name: filepath.Base(dir), dir: dir, state: &s, model: &model}
+	r, err := checkKubernetes(ctx, c, p)
+	if err != nil || !r.ready(expectedNodes(c)) {
+		return false, err
+	}
+
+	s.Status = stateReady
+	s.FailureMessage = ""
+	if err := c.writeState(); err != nil {
+		return false, errors.Wrap(err, "cluster is ready but received error while writing state")
+	}
+	return true, nil
+}
+
+func deployFailedError(s state) error {
+	msg := s.FailureMessage
+	for _, f := range s.FailureDetails {
+		msg += "\n" + f.String()
+	}
+	return errors.Errorf("cluster failed to deploy: %s", msg)
+}
+
+// checkRemoved checks if the cluster in dir has been removed.
+// Once the cluster is being removed and the resource group is gone from Azure, the local state is cleaned up.
+// If the deletion was started by `rm --no-wait`, its saved status is polled instead of checking for the resource group,
+// a failed deletion marks the cluster as dead. A dead cluster whose resource group still exists is an error, since
+// nothing is removing it.
+func checkRemoved(ctx context.Context, dir string, client groupsClient) (bool, error) {
+	s, err := readState(dir)
+	if err != nil {
+		if _, statErr := os.Stat(dir); os.IsNotExist(statErr) {
+			return true, nil
+		}
+		return false, err
+	}
+
+	if s.Status != stateRemoving && s.Status != stateDead {
+		return false, nil
+	}
+
+	if s.DeleteOperation != nil {
+		future, err := client.ResumeDelete(s.DeleteOperation)
+		if err != nil {
+			return false, err
+		}
+		done, err := future.Done(ctx)
+		if err != nil && !isAzureNotFound(err) {
+			if _, throttled := azureThrottled(err); throttled {
+				return false, nil
+			}
+			if !done {
+				return false, errors.Wrapf(err, "error checking deletion of resource group %q", s.ResourceGroup)
+			}
+			s.Status = stateDead
+			s.FailureMessage = "error deleting resource group: " + err.Error()
+			s.DeleteOperation = nil
+			writeState(dir, s)
+			return false, errors.Wrapf(err, "error deleting resource group %q", s.ResourceGroup)
+		}
+		if !done {
+			return false, nil
+		}
+	} else {
+		exists, err := client.Exists(ctx, s.ResourceGroup)
+		if err != nil {
+			return false, errors.Wrapf(err, "error checking for resource group %q", s.ResourceGroup)
+		}
+		if exists {
+			if s.Status == stateDead {
+				// Removing it failed, nothing is going to delete it.
+				msg := s.FailureMessage
+				if msg == "" {
+					msg = "resource group " + s.ResourceGroup + " still exists"
+				}
+				return false, errors.Errorf("cluster failed to be removed: %s", msg)
+			}
+			return false, nil
+		}
+	}
+
+	if err := removeLocalCluster(filepath.Base(dir), dir, s); err != nil {
+		return false, err
+	}
+	return true, nil
+}
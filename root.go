@@ -26,6 +26,7 @@ func main() {
 	cmd := &cobra.Command{
 		Use:           filepath.Base(os.Args[0]),
 		Short:         "Quickly create and manage test Kubernetes clusters on Azure",
+		Version:       commands.Version,
 		SilenceUsage:  true,
 		SilenceErrors: true,
 		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
@@ -39,10 +40,12 @@ func main() {
 				return err
 			}
 
-			chSig := make(chan os.Signal)
+			chSig := make(chan os.Signal, 1)
 			signal.Notify(chSig, syscall.SIGTERM, syscall.SIGINT)
 			go func() {
 				<-chSig
+				// A second signal gets the default behavior, so an unresponsive testrig can still be stopped.
+				signal.Stop(chSig)
 				cancel()
 			}()
 
@@ -56,6 +59,8 @@ func main() {
 	flags := cmd.PersistentFlags()
 	flags.StringVar(&stateDir, "state-dir", stateDir, "Directory to store state information to")
 	flags.StringVar(&configFile, "config", configFile, "Location of user config file")
+	flags.StringVar(&commands.FakeAzure, "fake-azure", os.Getenv("TESTRIG_FAKE_AZURE"), "Directory to keep state for a fake Azure backend in, for testing")
+	flags.MarkHidden("fake-azure")
 
 	if len(os.Args) > 1 {
 		err = flags.Parse(os.Args[1:])
@@ -69,14 +74,24 @@ func main() {
 
 	cmd.AddCommand(
 		commands.Create(ctx, stateDir, &cfg),
-		commands.List(ctx, stateDir),
+		commands.List(ctx, stateDir, &cfg),
 		commands.Inspect(ctx, stateDir),
 		commands.SSH(ctx, stateDir),
 		commands.KubeConfig(ctx, stateDir),
+		commands.Env(ctx, stateDir),
+		commands.Run(ctx, stateDir),
 		commands.Remove(ctx, stateDir, &cfg),
+		commands.Wait(ctx, stateDir, &cfg),
+		commands.GC(ctx, stateDir, &cfg),
+		commands.Adopt(ctx, stateDir, &cfg),
+		commands.Scale(ctx, stateDir),
+		commands.Upgrade(ctx, stateDir),
 	)
 
 	if err := cmd.Execute(); err != nil {
+		if e, ok := errors.Cause(err).(commands.ExitStatusError); ok {
+			os.Exit(e.Status)
+		}
 		io.WriteString(os.Stderr, err.Error()+"\n")
 		os.Exit(1)
 	}